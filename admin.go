@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hako/durafmt"
+)
+
+// adminTemplate is the template of the admin dashboard
+var adminTemplate *template.Template
+
+// adminRow is an upload in the admin dashboard
+type adminRow struct {
+	*Page
+	Age       string
+	Remaining string
+}
+
+// adminPage is the data for the admin dashboard
+type adminPage struct {
+	Config    Config
+	Rows      []adminRow
+	Blocked   []blockedHash
+	Reports   []reportRow
+	Total     int
+	TotalSize string
+	Message   string
+
+	// search, filter and sort
+	Query string
+	Type  string
+	Sort  string
+	Desc  bool
+}
+
+// reportRow is a report in the admin dashboard
+type reportRow struct {
+	report
+	Available bool
+}
+
+// adminColumn is a sortable column of the dashboard
+type adminColumn struct {
+	Name string
+	Sort string
+}
+
+// Types are the content type filters of the dashboard
+func (ap adminPage) Types() []string {
+	return []string{"image", "text", "audio", "video", "other"}
+}
+
+// Columns are the sortable columns of the dashboard
+func (ap adminPage) Columns() []adminColumn {
+	return []adminColumn{
+		{"Name", "name"},
+		{"Size", "size"},
+		{"Type", "type"},
+		{"Uploader", "uploader"},
+		{"Age", "age"},
+		{"Kept for", "expiry"},
+	}
+}
+
+// pageType returns the content type filter that matches an upload
+func pageType(p *Page) string {
+	switch {
+	case p.IsImage:
+		return "image"
+	case p.IsText:
+		return "text"
+	case p.IsAudio:
+		return "audio"
+	case p.IsVideo:
+		return "video"
+	}
+	return "other"
+}
+
+// matchesQuery returns whether an upload matches a search
+func matchesQuery(p *Page, query string) bool {
+	query = strings.ToLower(query)
+	for _, field := range []string{p.ID, p.Name, p.ContentType, p.Hash, p.Uploader} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortPages sorts the uploads by a column of the dashboard
+func sortPages(list []*Page, by string, desc bool) {
+	less := func(i, j int) bool {
+		switch by {
+		case "name":
+			return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+		case "size":
+			return list[i].Size < list[j].Size
+		case "type":
+			return list[i].ContentType < list[j].ContentType
+		case "uploader":
+			return list[i].Uploader < list[j].Uploader
+		case "expiry":
+			return list[i].timeRemaining() < list[j].timeRemaining()
+		}
+		// by age
+		return list[i].Modified.After(list[j].Modified)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if desc {
+			return less(j, i)
+		}
+		return less(i, j)
+	})
+}
+
+// handleAdmin handles GET /admin with the dashboard of all uploads
+func handleAdmin(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	ap := adminPage{
+		Config:  getConfig(),
+		Blocked: blocklist.List(),
+		Message: query.Get("msg"),
+		Query:   strings.TrimSpace(query.Get("q")),
+		Type:    query.Get("type"),
+		Sort:    query.Get("sort"),
+		Desc:    query.Get("desc") != "",
+	}
+	ap.Config.PublicURL = publicURL(r)
+	for _, rep := range reports.Open() {
+		p, ok := pages.Get(rep.ShareID)
+		ap.Reports = append(ap.Reports, reportRow{report: rep, Available: ok && p.Hash == rep.Hash})
+	}
+
+	var list []*Page
+	var totalSize int64
+	for _, p := range pages.List() {
+		if ap.Query != "" && !matchesQuery(p, ap.Query) {
+			continue
+		}
+		if ap.Type != "" && pageType(p) != ap.Type {
+			continue
+		}
+		list = append(list, p)
+		totalSize += p.Size
+	}
+	sortPages(list, ap.Sort, ap.Desc)
+	for _, p := range list {
+		ap.Rows = append(ap.Rows, adminRow{
+			Page:      p,
+			Age:       HumanizeTime(p.Modified),
+			Remaining: durafmt.Parse(p.timeRemaining().Round(time.Minute)).String(),
+		})
+	}
+	ap.Total = len(list)
+	ap.TotalSize = HumanizeBytes(totalSize)
+
+	w.Header().Set("Cache-Control", "no-store")
+	return adminTemplate.Execute(w, ap)
+}
+
+// adminRedirect sends the admin back to the dashboard with a message
+func adminRedirect(w http.ResponseWriter, r *http.Request, msg string) error {
+	http.Redirect(w, r, getConfig().BasePath+"/admin?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+	return nil
+}
+
+// adminLoadPage loads the upload for the ID in the route
+func adminLoadPage(r *http.Request) (p *Page, err error) {
+	id := filepath.Base(routeParam(r, "id"))
+	p, err = loadPageInfo(id)
+	if err != nil {
+		err = errDoesNotExist(id)
+	}
+	return
+}
+
+// handleAdminDelete handles POST /admin/<id>/delete
+func handleAdminDelete(w http.ResponseWriter, r *http.Request) (err error) {
+	id := filepath.Base(routeParam(r, "id"))
+	err = deletePage(r, id, deletionAdmin)
+	if err != nil {
+		return
+	}
+	err = reports.Resolve(reportDeleted, func(rep report) bool { return rep.ShareID == id })
+	if err != nil {
+		return
+	}
+	return adminRedirect(w, r, fmt.Sprintf("Removed %s.", id))
+}
+
+// handleAdminExtend handles POST /admin/<id>/extend, which keeps the upload
+// for the given number of hours longer
+func handleAdminExtend(w http.ResponseWriter, r *http.Request) (err error) {
+	hours, err := strconv.ParseFloat(r.FormValue("hours"), 64)
+	if err != nil || hours <= 0 {
+		return fmt.Errorf("Invalid number of hours.")
+	}
+	p, err := adminLoadPage(r)
+	if err != nil {
+		return
+	}
+	p.Extension += time.Duration(hours * float64(time.Hour))
+	err = savePageInfo(p)
+	if err != nil {
+		return
+	}
+	p, err = loadPageInfo(p.ID)
+	if err != nil {
+		return
+	}
+	pages.Put(p)
+	auditRequest(r, auditEventExtend, p)
+	return adminRedirect(w, r, fmt.Sprintf("%s is now kept for %s.", p.ID, p.TimeToDeletionHuman))
+}
+
+// handleAdminBlock handles POST /admin/<id>/block, which blocks the hash
+// of the upload from being uploaded again
+func handleAdminBlock(w http.ResponseWriter, r *http.Request) (err error) {
+	p, err := adminLoadPage(r)
+	if err != nil {
+		return
+	}
+	return blockHash(w, r, p, r.FormValue("reason"))
+}
+
+// blockHash blocks the hash of an upload, removes all copies of it and
+// resolves its reports
+func blockHash(w http.ResponseWriter, r *http.Request, p *Page, reason string) (err error) {
+	err = blocklist.Block(blockedHash{Hash: p.Hash, Name: p.Name, Reason: reason})
+	if err != nil {
+		return
+	}
+	auditRequest(r, auditEventBlock, p)
+	removed := removeCopies(r, p.Hash, deletionBlocked)
+	err = reports.Resolve(reportBlocked, func(rep report) bool { return rep.Hash == p.Hash })
+	if err != nil {
+		return
+	}
+	return adminRedirect(w, r, fmt.Sprintf("Blocked %s and removed %d copies.", p.Hash, len(removed)))
+}
+
+// handleAdminReport handles POST /admin/reports/<report>/<action>, which
+// dismisses the report or deletes or blocks the reported file
+func handleAdminReport(w http.ResponseWriter, r *http.Request) (err error) {
+	rep, ok := reports.Get(routeParam(r, "report"))
+	if !ok {
+		return notFoundError{"Report does not exist."}
+	}
+	switch routeParam(r, "action") {
+	case "dismiss":
+		err = reports.Resolve(reportDismissed, func(other report) bool { return other.ID == rep.ID })
+		if err != nil {
+			return
+		}
+		return adminRedirect(w, r, "Dismissed the report.")
+	case "delete":
+		if p, ok := pages.Get(rep.ShareID); ok && p.Hash == rep.Hash {
+			err = deletePage(r, rep.ShareID, deletionAdmin)
+			if err != nil {
+				return
+			}
+		}
+		err = reports.Resolve(reportDeleted, func(other report) bool { return other.ShareID == rep.ShareID && other.Hash == rep.Hash })
+		if err != nil {
+			return
+		}
+		return adminRedirect(w, r, fmt.Sprintf("Removed %s.", rep.ShareID))
+	case "block":
+		reason := "reported: " + rep.ReasonHuman()
+		return blockHash(w, r, &Page{ID: rep.ShareID, Name: rep.Name, Hash: rep.Hash}, reason)
+	}
+	return errNotFound
+}
+
+// handleAdminUnblock handles POST /admin/blocked/<hash>/unblock
+func handleAdminUnblock(w http.ResponseWriter, r *http.Request) (err error) {
+	hash := routeParam(r, "hash")
+	if !blocklist.IsBlocked(hash) {
+		return notFoundError{fmt.Sprintf("%s is not blocked.", hash)}
+	}
+	err = blocklist.Unblock(hash)
+	if err != nil {
+		return
+	}
+	auditRequest(r, auditEventUnblock, &Page{Hash: hash})
+	return adminRedirect(w, r, fmt.Sprintf("Unblocked %s.", hash))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageType(t *testing.T) {
+	tests := []struct {
+		p    Page
+		want string
+	}{
+		{Page{IsImage: true}, "image"},
+		{Page{IsText: true, IsASCII: true}, "text"},
+		{Page{IsAudio: true}, "audio"},
+		{Page{IsVideo: true}, "video"},
+		{Page{}, "other"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, pageType(&tt.p))
+	}
+}
+
+func TestMatchesQuery(t *testing.T) {
+	p := &Page{ID: "abc", Name: "Holiday.JPG", ContentType: "image/jpeg", Hash: "0123abcd", Uploader: "1.2.3.4"}
+	for query, want := range map[string]bool{
+		"":        true,
+		"holiday": true,
+		"JPEG":    true,
+		"0123":    true,
+		"1.2.3":   true,
+		"abc":     true,
+		"png":     false,
+	} {
+		assert.Equal(t, want, matchesQuery(p, query), query)
+	}
+}
+
+func TestSortPages(t *testing.T) {
+	now := time.Now()
+	a := &Page{ID: "a", Name: "b.txt", Size: 30, ContentType: "text/plain", Uploader: "2", Modified: now.Add(-time.Hour), TimeToDeletion: 3 * time.Hour}
+	b := &Page{ID: "b", Name: "A.png", Size: 10, ContentType: "image/png", Uploader: "3", Modified: now, TimeToDeletion: time.Hour}
+	c := &Page{ID: "c", Name: "c.mp4", Size: 20, ContentType: "video/mp4", Uploader: "1", Modified: now.Add(-2 * time.Hour), TimeToDeletion: 4 * time.Hour}
+	tests := []struct {
+		by   string
+		desc bool
+		want string
+	}{
+		{"", false, "bac"},
+		{"age", true, "cab"},
+		{"name", false, "bac"},
+		{"size", false, "bca"},
+		{"size", true, "acb"},
+		{"type", false, "bac"},
+		{"uploader", false, "cab"},
+		{"expiry", false, "bac"},
+	}
+	for _, tt := range tests {
+		list := []*Page{a, b, c}
+		sortPages(list, tt.by, tt.desc)
+		got := ""
+		for _, p := range list {
+			got += p.ID
+		}
+		assert.Equal(t, tt.want, got, tt.by)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	useTestConfig(t)
+	old := blocklist
+	t.Cleanup(func() { blocklist = old })
+	blocklist = &hashBlocklist{hashes: make(map[string]blockedHash)}
+
+	assert.Nil(t, blocklist.Block(blockedHash{Hash: "abc", Name: "a.txt", Blocked: time.Now().Add(-time.Hour)}))
+	assert.Nil(t, blocklist.Block(blockedHash{Hash: "def", Name: "d.txt"}))
+	assert.True(t, blocklist.IsBlocked("abc"))
+	assert.False(t, blocklist.IsBlocked("xyz"))
+	list := blocklist.List()
+	assert.Len(t, list, 2)
+	assert.Equal(t, "def", list[0].Hash)
+
+	// the blocked hashes survive a restart
+	blocklist = &hashBlocklist{hashes: make(map[string]blockedHash)}
+	assert.Nil(t, loadBlocklist())
+	assert.True(t, blocklist.IsBlocked("abc"))
+	assert.Nil(t, blocklist.Unblock("abc"))
+	assert.Nil(t, loadBlocklist())
+	assert.False(t, blocklist.IsBlocked("abc"))
+	assert.True(t, blocklist.IsBlocked("def"))
+}
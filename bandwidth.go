@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// throttleChunk is the most that is read or written at once when the
+// bandwidth is limited
+const throttleChunk = 32 * 1024
+
+// newBandwidthLimiter returns a limiter for a number of bytes per second,
+// or nil if there is no limit
+func newBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := int(bytesPerSecond)
+	if burst < throttleChunk {
+		burst = throttleChunk
+	}
+	limiter := rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+	// start with an empty bucket so that the rate holds from the start
+	limiter.AllowN(time.Now(), burst)
+	return limiter
+}
+
+// sharedBandwidth is a bandwidth limit that is shared by all connections,
+// which follows the configuration when it is reloaded
+type sharedBandwidth struct {
+	sync.Mutex
+	bytesPerSecond int64
+	limiter        *rate.Limiter
+}
+
+// the aggregate bandwidth limits
+var (
+	sharedDownloadBandwidth = &sharedBandwidth{}
+	sharedUploadBandwidth   = &sharedBandwidth{}
+)
+
+// get returns the shared limiter for the configured limit, or nil if
+// there is no limit
+func (sb *sharedBandwidth) get(bytesPerSecond int64) *rate.Limiter {
+	sb.Lock()
+	defer sb.Unlock()
+	if bytesPerSecond != sb.bytesPerSecond {
+		sb.bytesPerSecond = bytesPerSecond
+		sb.limiter = newBandwidthLimiter(bytesPerSecond)
+	}
+	return sb.limiter
+}
+
+// bandwidthLimiters returns the limiters for a connection: its own limit,
+// which is higher for clients with an API token, and the aggregate limit
+func bandwidthLimiters(r *http.Request, perConnection, perConnectionAuth int64, shared *sharedBandwidth, sharedBytesPerSecond int64) (limiters []*rate.Limiter) {
+	if apiToken(r) != "" {
+		perConnection = perConnectionAuth
+	}
+	for _, limiter := range []*rate.Limiter{newBandwidthLimiter(perConnection), shared.get(sharedBytesPerSecond)} {
+		if limiter != nil {
+			limiters = append(limiters, limiter)
+		}
+	}
+	return
+}
+
+// downloadBandwidth returns the bandwidth limiters for a download
+func downloadBandwidth(r *http.Request, cfg Config) []*rate.Limiter {
+	return bandwidthLimiters(r, cfg.DownloadBytesPerSecond, cfg.DownloadBytesPerSecondAuth, sharedDownloadBandwidth, cfg.DownloadBytesPerSecondTotal)
+}
+
+// uploadBandwidth returns the bandwidth limiters for an upload
+func uploadBandwidth(r *http.Request, cfg Config) []*rate.Limiter {
+	return bandwidthLimiters(r, cfg.UploadBytesPerSecond, cfg.UploadBytesPerSecondAuth, sharedUploadBandwidth, cfg.UploadBytesPerSecondTotal)
+}
+
+// waitBandwidth waits until all the limiters allow n bytes
+func waitBandwidth(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, limiter := range limiters {
+		if err := limiter.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throttledWriter limits the bytes per second written through it
+type throttledWriter struct {
+	io.Writer
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+// newThrottledWriter limits a writer with the limiters, or returns it as it
+// is if there are none
+func newThrottledWriter(ctx context.Context, w io.Writer, limiters []*rate.Limiter) io.Writer {
+	if len(limiters) == 0 {
+		return w
+	}
+	return &throttledWriter{Writer: w, ctx: ctx, limiters: limiters}
+}
+
+func (tw *throttledWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		if err = waitBandwidth(tw.ctx, tw.limiters, len(chunk)); err != nil {
+			return
+		}
+		var m int
+		m, err = tw.Writer.Write(chunk)
+		n += m
+		if err != nil {
+			return
+		}
+		p = p[len(chunk):]
+	}
+	return
+}
+
+// throttledReader limits the bytes per second read through it
+type throttledReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+// newThrottledReader limits a reader with the limiters, or returns it as it
+// is if there are none
+func newThrottledReader(ctx context.Context, r io.ReadCloser, limiters []*rate.Limiter) io.ReadCloser {
+	if len(limiters) == 0 {
+		return r
+	}
+	return &throttledReader{ReadCloser: r, ctx: ctx, limiters: limiters}
+}
+
+func (tr *throttledReader) Read(p []byte) (n int, err error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err = tr.ReadCloser.Read(p)
+	if n > 0 {
+		if errWait := waitBandwidth(tr.ctx, tr.limiters, n); errWait != nil && err == nil {
+			err = errWait
+		}
+	}
+	return
+}
+
+// throttleUpload limits the bandwidth of the body of an upload
+func throttleUpload(r *http.Request) {
+	r.Body = newThrottledReader(r.Context(), r.Body, uploadBandwidth(r, getConfig()))
+}
+
+// throttledResponseWriter limits the bandwidth of a response
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (tw *throttledResponseWriter) Write(p []byte) (int, error) {
+	return tw.w.Write(p)
+}
+
+// throttleResponse limits the bandwidth of a response with the limiters, for
+// handlers that write to the http.ResponseWriter themselves
+func throttleResponse(w http.ResponseWriter, r *http.Request, limiters []*rate.Limiter) http.ResponseWriter {
+	if len(limiters) == 0 {
+		return w
+	}
+	return &throttledResponseWriter{ResponseWriter: w, w: newThrottledWriter(r.Context(), w, limiters)}
+}
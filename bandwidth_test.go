@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestBandwidthLimiters(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.APITokens = "secret"
+	setConfig(cfg)
+	tests := []struct {
+		name          string
+		token         bool
+		perConnection int64
+		auth          int64
+		total         int64
+		want          []rate.Limit
+	}{
+		{"no limits", false, 0, 0, 0, nil},
+		{"per connection", false, 1000, 0, 0, []rate.Limit{1000}},
+		{"total", false, 0, 0, 5000, []rate.Limit{5000}},
+		{"both", false, 1000, 2000, 5000, []rate.Limit{1000, 5000}},
+		{"token", true, 1000, 2000, 5000, []rate.Limit{2000, 5000}},
+		{"token without its own limit", true, 1000, 0, 5000, []rate.Limit{5000}},
+		{"token without limits", true, 1000, 0, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/123/a.txt", nil)
+			if tt.token {
+				r.Header.Set("Authorization", "Bearer secret")
+			}
+			var limits []rate.Limit
+			for _, limiter := range bandwidthLimiters(r, tt.perConnection, tt.auth, &sharedBandwidth{}, tt.total) {
+				limits = append(limits, limiter.Limit())
+			}
+			assert.Equal(t, tt.want, limits)
+		})
+	}
+}
+
+func TestSharedBandwidth(t *testing.T) {
+	sb := &sharedBandwidth{}
+	assert.Nil(t, sb.get(0))
+	limiter := sb.get(1000)
+	assert.Same(t, limiter, sb.get(1000))
+	// a reloaded config replaces the limiter
+	assert.Equal(t, rate.Limit(2000), sb.get(2000).Limit())
+}
+
+func TestThrottle(t *testing.T) {
+	const bytesPerSecond = 4 * throttleChunk
+	data := bytes.Repeat([]byte("x"), bytesPerSecond/2)
+
+	start := time.Now()
+	var out bytes.Buffer
+	w := newThrottledWriter(context.Background(), &out, []*rate.Limiter{newBandwidthLimiter(bytesPerSecond)})
+	n, err := w.Write(data)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), n)
+	assert.InDelta(t, 0.5, time.Since(start).Seconds(), 0.2)
+
+	start = time.Now()
+	rd := newThrottledReader(context.Background(), io.NopCloser(bytes.NewReader(data)), []*rate.Limiter{newBandwidthLimiter(bytesPerSecond)})
+	b, err := io.ReadAll(rd)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+	assert.InDelta(t, 0.5, time.Since(start).Seconds(), 0.2)
+
+	// without limiters nothing is wrapped
+	assert.Same(t, &out, newThrottledWriter(context.Background(), &out, nil))
+
+	// a cancelled request stops waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = newThrottledWriter(ctx, &out, []*rate.Limiter{newBandwidthLimiter(bytesPerSecond)}).Write(data)
+	assert.NotNil(t, err)
+}
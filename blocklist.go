@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// blocklistFile is where the blocked hashes are saved, in the data directory
+const blocklistFile = "shareblocklist.json"
+
+// errBlocked is returned for uploads of blocked files
+var errBlocked = errors.New("This file is not allowed.")
+
+// blockedHash is the hash of a file that may not be uploaded
+type blockedHash struct {
+	Hash    string
+	Name    string
+	Reason  string
+	Blocked time.Time
+}
+
+// hashBlocklist is the set of blocked hashes, which is saved to disk every
+// time it changes.
+type hashBlocklist struct {
+	sync.RWMutex
+	hashes map[string]blockedHash
+}
+
+// blocklist holds the hashes of files that may not be uploaded
+var blocklist = &hashBlocklist{hashes: make(map[string]blockedHash)}
+
+// loadBlocklist loads the blocked hashes from the data directory
+func loadBlocklist() (err error) {
+	b, err := os.ReadFile(path.Join(getConfig().ContentDirectory, blocklistFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	hashes := make(map[string]blockedHash)
+	err = json.Unmarshal(b, &hashes)
+	if err != nil {
+		return
+	}
+	blocklist.Lock()
+	blocklist.hashes = hashes
+	blocklist.Unlock()
+	log.Debugf("loaded %d blocked hashes", len(hashes))
+	return
+}
+
+// save writes the blocked hashes to the data directory, the lock must be
+// held
+func (bl *hashBlocklist) save() (err error) {
+	b, err := json.MarshalIndent(bl.hashes, "", " ")
+	if err != nil {
+		return
+	}
+	fname := path.Join(getConfig().ContentDirectory, blocklistFile)
+	err = os.WriteFile(fname+".tmp", b, 0644)
+	if err != nil {
+		return
+	}
+	return os.Rename(fname+".tmp", fname)
+}
+
+// Block blocks a hash
+func (bl *hashBlocklist) Block(entry blockedHash) error {
+	bl.Lock()
+	defer bl.Unlock()
+	if entry.Blocked.IsZero() {
+		entry.Blocked = time.Now()
+	}
+	bl.hashes[entry.Hash] = entry
+	return bl.save()
+}
+
+// Unblock allows a hash again
+func (bl *hashBlocklist) Unblock(hash string) error {
+	bl.Lock()
+	defer bl.Unlock()
+	delete(bl.hashes, hash)
+	return bl.save()
+}
+
+// IsBlocked returns whether a hash is blocked
+func (bl *hashBlocklist) IsBlocked(hash string) bool {
+	bl.RLock()
+	defer bl.RUnlock()
+	_, ok := bl.hashes[hash]
+	return ok
+}
+
+// List returns the blocked hashes, newest first
+func (bl *hashBlocklist) List() (list []blockedHash) {
+	bl.RLock()
+	for _, entry := range bl.hashes {
+		list = append(list, entry)
+	}
+	bl.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Blocked.After(list[j].Blocked)
+	})
+	return
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// staticHashes are the fingerprints of the embedded static files, keyed by
+// the name of the file (without .gz)
+var staticHashes map[string]string
+
+// loadStaticHashes fingerprints the embedded static files
+func loadStaticHashes() (err error) {
+	staticHashes = make(map[string]string)
+	return fs.WalkDir(content, "static", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(name, ".gz") {
+			return err
+		}
+		b, err := content.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		h := md5.Sum(b)
+		staticHashes[strings.TrimSuffix(strings.TrimPrefix(name, "static/"), ".gz")] = hex.EncodeToString(h[:])[:10]
+		return nil
+	})
+}
+
+// staticURL returns the fingerprinted URL of a static file, which can be
+// cached forever since the URL changes with the file.
+func staticURL(name string) string {
+	u := getConfig().BasePath + "/static/" + name
+	if hash, ok := staticHashes[name]; ok {
+		u += "?v=" + hash
+	} else {
+		log.Debugf("no fingerprint for static file %s", name)
+	}
+	return u
+}
+
+// timeToDeletion returns how long data is kept, scaled by its size
+func timeToDeletion(cfg Config, size int64) time.Duration {
+	if size < 1 {
+		size = 1
+	}
+	minutes := cfg.MinutesPerGigabyte * 1000000000 / float64(size)
+	if minutes > LongTime.Minutes() {
+		return LongTime
+	}
+	return time.Duration(minutes * float64(time.Minute))
+}
+
+// timeRemaining returns how long until the data is deleted
+func (p *Page) timeRemaining() time.Duration {
+	remaining := p.TimeToDeletion - time.Since(p.Modified)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// etagMatches returns whether an If-None-Match header matches the ETag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotModified sets the validators of the response and answers a
+// conditional GET with 304 Not Modified when the client already has the
+// current version. It returns whether the response is finished.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	notModified := false
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		// If-None-Match takes precedence over If-Modified-Since
+		notModified = etag != "" && etagMatches(ifNoneMatch, etag)
+	} else if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ifModifiedSince)
+		notModified = err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	if notModified {
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Encoding")
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return notModified
+}
+
+// setUploadCacheControl lets clients cache uploaded data until it is
+// deleted (but at most a year).
+func (p *Page) setUploadCacheControl(w http.ResponseWriter) {
+	maxAge := p.timeRemaining()
+	if maxAge > Year {
+		maxAge = Year
+	}
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+}
+
+// setStaticCacheControl caches fingerprinted static files forever, and
+// makes clients revalidate the others.
+func setStaticCacheControl(w http.ResponseWriter, r *http.Request, name string) {
+	if v := r.URL.Query().Get("v"); v != "" && v == staticHashes[name] {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEtagMatches(t *testing.T) {
+	for ifNoneMatch, want := range map[string]bool{
+		`"abc"`:            true,
+		`W/"abc"`:          true,
+		`"def", "abc"`:     true,
+		`*`:                true,
+		`"def"`:            false,
+		`abc`:              false,
+		`"abcd", W/"ab"`:   false,
+		` "x" ,  W/"abc" `: true,
+	} {
+		assert.Equal(t, want, etagMatches(ifNoneMatch, `"abc"`), ifNoneMatch)
+	}
+}
+
+func TestCheckNotModified(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 600, time.UTC)
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		etag    string
+		want    bool
+	}{
+		{"unconditional", "GET", nil, `"abc"`, false},
+		{"etag", "GET", map[string]string{"If-None-Match": `"abc"`}, `"abc"`, true},
+		{"etag on head", "HEAD", map[string]string{"If-None-Match": `"abc"`}, `"abc"`, true},
+		{"etag on post", "POST", map[string]string{"If-None-Match": `"abc"`}, `"abc"`, false},
+		{"other etag", "GET", map[string]string{"If-None-Match": `"def"`}, `"abc"`, false},
+		{"no etag", "GET", map[string]string{"If-None-Match": `"abc"`}, "", false},
+		{"modified since", "GET", map[string]string{"If-Modified-Since": "Tue, 02 Jan 2024 03:04:04 GMT"}, `"abc"`, false},
+		{"not modified since", "GET", map[string]string{"If-Modified-Since": "Tue, 02 Jan 2024 03:04:05 GMT"}, `"abc"`, true},
+		{"bad date", "GET", map[string]string{"If-Modified-Since": "yesterday"}, `"abc"`, false},
+		{"etag takes precedence", "GET", map[string]string{
+			"If-None-Match":     `"def"`,
+			"If-Modified-Since": "Tue, 02 Jan 2024 03:04:05 GMT",
+		}, `"abc"`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/123/a.txt", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			w.Header().Set("Content-Type", "text/plain")
+			assert.Equal(t, tt.want, checkNotModified(w, r, tt.etag, modified))
+			assert.Equal(t, tt.etag, w.Header().Get("ETag"))
+			assert.Equal(t, "Tue, 02 Jan 2024 03:04:05 GMT", w.Header().Get("Last-Modified"))
+			if tt.want {
+				assert.Equal(t, http.StatusNotModified, w.Code)
+				assert.Empty(t, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestTimeToDeletion(t *testing.T) {
+	cfg := Config{MinutesPerGigabyte: 30}
+	assert.Equal(t, 30*time.Minute, timeToDeletion(cfg, 1000000000))
+	assert.Equal(t, 60*time.Minute, timeToDeletion(cfg, 500000000))
+	assert.Equal(t, LongTime, timeToDeletion(cfg, 0))
+}
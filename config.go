@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	log "github.com/schollz/logger"
+)
+
+// configValue holds the current Config snapshot. It is replaced as a whole
+// when the configuration is reloaded so that readers never see a partially
+// updated Config.
+var configValue atomic.Value
+
+// configReloadLock serializes reloads
+var configReloadLock sync.Mutex
+
+// flagConfig is the configuration as specified on the command-line, which
+// is the base that the config file and environment are applied on top of
+// every time the configuration is (re)loaded.
+var flagConfig Config
+
+// configFile is the path to an optional JSON configuration file
+var configFile string
+
+// getConfig returns the current configuration snapshot.
+func getConfig() Config {
+	return configValue.Load().(Config)
+}
+
+// setConfig replaces the current configuration snapshot.
+func setConfig(cfg Config) {
+	configValue.Store(cfg)
+}
+
+// loadConfig builds a configuration by applying the config file and then the
+// environment variables on top of the command-line flags.
+func loadConfig() (cfg Config, err error) {
+	cfg = flagConfig
+
+	if configFile != "" {
+		var b []byte
+		b, err = os.ReadFile(configFile)
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(b, &cfg)
+		if err != nil {
+			err = fmt.Errorf("could not parse %s: %s", configFile, err.Error())
+			return
+		}
+	}
+
+	err = applyEnv(&cfg)
+	return
+}
+
+// finalizeConfig fills in the settings that are computed from others.
+func finalizeConfig(cfg *Config) {
+	cfg.MaxBytesPerFileHuman = HumanizeBytes(cfg.MaxBytesPerFile)
+	cfg.BasePath = normalizeBasePath(cfg.BasePath)
+	cfg.trustedProxies = parseTrustedProxies(cfg.TrustedProxies)
+	cfg.publicURLSet = cfg.PublicURL != ""
+	cfg.userContentHost = parseUserContentHost(cfg.UserContentURL)
+	cfg.rateUploads = parseRateOrWarn("rate-uploads", cfg.RateUploads)
+	cfg.rateDownloads = parseRateOrWarn("rate-downloads", cfg.RateDownloads)
+	cfg.rateLookups = parseRateOrWarn("rate-lookups", cfg.RateLookups)
+	cfg.rateExists = parseRateOrWarn("rate-exists", cfg.RateExists)
+	cfg.rateReports = parseRateOrWarn("rate-reports", cfg.RateReports)
+	cfg.mimeTypes = parseMimeTypesOrWarn(cfg.MimeTypes)
+	cfg.declaredTypes = parseDeclaredTypes(cfg.DeclaredTypes)
+	if cfg.PublicURL == "" {
+		cfg.PublicURL = cfg.defaultPublicURL()
+	}
+}
+
+// applyEnv overrides the configuration with any environment variables
+// that are set.
+func applyEnv(cfg *Config) (err error) {
+	if dataDirEnv := os.Getenv("DATA_DIR"); dataDirEnv != "" {
+		cfg.ContentDirectory = dataDirEnv
+	}
+	if publicUrlEnv := os.Getenv("PUBLIC_URL"); publicUrlEnv != "" {
+		cfg.PublicURL = publicUrlEnv
+	}
+	if basePathEnv := os.Getenv("BASE_PATH"); basePathEnv != "" {
+		cfg.BasePath = basePathEnv
+	}
+	if userContentURLEnv := os.Getenv("USERCONTENT_URL"); userContentURLEnv != "" {
+		cfg.UserContentURL = userContentURLEnv
+	}
+	if trustedProxiesEnv := os.Getenv("TRUSTED_PROXIES"); trustedProxiesEnv != "" {
+		cfg.TrustedProxies = trustedProxiesEnv
+	}
+	if adminPasswordEnv := os.Getenv("ADMIN_PASSWORD"); adminPasswordEnv != "" {
+		cfg.AdminPassword = adminPasswordEnv
+	}
+	if portEnv := os.Getenv("PORT"); portEnv != "" {
+		cfg.Port = portEnv
+	}
+	if debugEnv := os.Getenv("DEBUG"); debugEnv != "" {
+		cfg.Debug, err = strconv.ParseBool(debugEnv)
+		if err != nil {
+			return fmt.Errorf("DEBUG: %s", err.Error())
+		}
+	}
+	if maxFileBytesEnv := os.Getenv("MAX_FILE_BYTES"); maxFileBytesEnv != "" {
+		cfg.MaxBytesPerFile, err = strconv.ParseInt(maxFileBytesEnv, 10, 64)
+		if err != nil {
+			return fmt.Errorf("MAX_FILE_BYTES: %s", err.Error())
+		}
+	}
+	if maxTotalBytesEnv := os.Getenv("MAX_TOTAL_BYTES"); maxTotalBytesEnv != "" {
+		cfg.MaxBytesTotal, err = strconv.ParseInt(maxTotalBytesEnv, 10, 64)
+		if err != nil {
+			return fmt.Errorf("MAX_TOTAL_BYTES: %s", err.Error())
+		}
+	}
+	if minPerGigEnv := os.Getenv("MIN_PER_GIG"); minPerGigEnv != "" {
+		cfg.MinutesPerGigabyte, err = strconv.ParseFloat(minPerGigEnv, 64)
+		if err != nil {
+			return fmt.Errorf("MIN_PER_GIG: %s", err.Error())
+		}
+	}
+	return
+}
+
+// setLogLevel sets the logging level from the configuration
+func setLogLevel(cfg Config) {
+	if cfg.Debug {
+		log.SetLevel("debug")
+	} else {
+		log.SetLevel("info")
+	}
+}
+
+// reloadConfig reloads the configuration and swaps it in for new requests.
+// Uploads that are in progress keep using the state they already have.
+// Settings that can only be changed with a restart are kept as they are.
+func reloadConfig() {
+	configReloadLock.Lock()
+	defer configReloadLock.Unlock()
+
+	old := getConfig()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Errorf("config reload failed, keeping current config: %s", err.Error())
+		return
+	}
+	if cfg.Port != old.Port {
+		log.Warnf("config reload: port change to %s requires a restart", cfg.Port)
+		cfg.Port = old.Port
+	}
+	if cfg.ContentDirectory != old.ContentDirectory {
+		log.Warnf("config reload: data directory change to %s requires a restart", cfg.ContentDirectory)
+		cfg.ContentDirectory = old.ContentDirectory
+	}
+	if cfg.tlsEnabled() != old.tlsEnabled() || cfg.ACMEDomains != old.ACMEDomains || cfg.HTTPPort != old.HTTPPort {
+		log.Warnf("config reload: TLS listener changes require a restart")
+		cfg.TLSCert, cfg.TLSKey, cfg.ACMEDomains, cfg.HTTPPort = old.TLSCert, old.TLSKey, old.ACMEDomains, old.HTTPPort
+	}
+	if cfg.TLSCert != "" {
+		// pick up renewed certificates
+		if err = loadCertificate(cfg); err != nil {
+			log.Errorf("config reload failed, keeping current config: %s", err.Error())
+			return
+		}
+	}
+	if cfg.AccessLog != old.AccessLog || cfg.AuditLog != old.AuditLog {
+		log.Warnf("config reload: log file changes require a restart")
+		cfg.AccessLog, cfg.AuditLog = old.AccessLog, old.AuditLog
+	}
+	finalizeConfig(&cfg)
+
+	// pick up log files that were moved away by logrotate
+	reopenLogs()
+	setLogLevel(cfg)
+	setConfig(cfg)
+	log.Infof("config reloaded: max-file=%s max-total=%s min-per-gig=%g public=%s debug=%v",
+		cfg.MaxBytesPerFileHuman, HumanizeBytes(cfg.MaxBytesTotal), cfg.MinutesPerGigabyte, cfg.PublicURL, cfg.Debug)
+}
+
+// watchConfigReload reloads the configuration every time the process
+// receives a SIGHUP.
+func watchConfigReload() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Info("received SIGHUP, reloading config")
+			reloadConfig()
+		}
+	}()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		wantPort string
+		wantMax  int64
+		wantErr  bool
+	}{
+		{
+			name:     "flags",
+			wantPort: "8222",
+			wantMax:  100,
+		},
+		{
+			name:     "file over flags",
+			file:     `{"Port": "9000", "MaxBytesPerFile": 200}`,
+			wantPort: "9000",
+			wantMax:  200,
+		},
+		{
+			name:     "env over file",
+			file:     `{"Port": "9000", "MaxBytesPerFile": 200}`,
+			env:      map[string]string{"PORT": "9001", "MAX_FILE_BYTES": "300"},
+			wantPort: "9001",
+			wantMax:  300,
+		},
+		{
+			name:     "env over flags",
+			env:      map[string]string{"MAX_FILE_BYTES": "300"},
+			wantPort: "8222",
+			wantMax:  300,
+		},
+		{
+			name:    "bad file",
+			file:    `{"Port": `,
+			wantErr: true,
+		},
+		{
+			name:    "bad env",
+			env:     map[string]string{"MAX_FILE_BYTES": "lots"},
+			wantErr: true,
+		},
+	}
+	defer func(flags Config, file string) {
+		flagConfig, configFile = flags, file
+	}(flagConfig, configFile)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flagConfig = Config{Port: "8222", MaxBytesPerFile: 100}
+			configFile = ""
+			if tt.file != "" {
+				configFile = filepath.Join(t.TempDir(), "config.json")
+				assert.Nil(t, os.WriteFile(configFile, []byte(tt.file), 0644))
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := loadConfig()
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantPort, cfg.Port)
+			assert.Equal(t, tt.wantMax, cfg.MaxBytesPerFile)
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer func(cfg Config, flags Config, file string) {
+		setConfig(cfg)
+		flagConfig, configFile = flags, file
+	}(getConfig(), flagConfig, configFile)
+
+	old := getConfig()
+	flagConfig = old
+	configFile = filepath.Join(t.TempDir(), "config.json")
+	assert.Nil(t, os.WriteFile(configFile, []byte(`{"Port": "9000", "ContentDirectory": "elsewhere", "MaxBytesPerFile": 1024}`), 0644))
+	reloadConfig()
+	cfg := getConfig()
+	// the port and the data directory need a restart
+	assert.Equal(t, old.Port, cfg.Port)
+	assert.Equal(t, old.ContentDirectory, cfg.ContentDirectory)
+	assert.Equal(t, int64(1024), cfg.MaxBytesPerFile)
+	assert.Equal(t, "1.0 kB", cfg.MaxBytesPerFileHuman)
+
+	// a broken file keeps the current configuration
+	assert.Nil(t, os.WriteFile(configFile, []byte(`{`), 0644))
+	reloadConfig()
+	assert.Equal(t, int64(1024), getConfig().MaxBytesPerFile)
+}
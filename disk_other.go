@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package main
+
+// diskFree is not supported on this platform
+func diskFree(path string) (free uint64, err error) {
+	return 0, errDiskFreeUnsupported
+}
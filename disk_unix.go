@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import "syscall"
+
+// diskFree returns the number of bytes available on the disk of a path
+func diskFree(path string) (free uint64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return
+	}
+	free = uint64(st.Bavail) * uint64(st.Bsize)
+	return
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// startTime is when the server started
+var startTime = time.Now()
+
+var errDiskFreeUnsupported = errors.New("free disk space is not supported on this platform")
+
+// handleHealthz handles GET /healthz, which only checks that the process
+// is alive and serving.
+func handleHealthz(w http.ResponseWriter, r *http.Request) error {
+	jsonResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+	return nil
+}
+
+// readiness is the result of the readiness checks
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// checkReady checks whether share can take uploads: the data directory is
+// writable, there is enough free disk space, the index of the uploads is
+// loaded and the server is not shutting down.
+func checkReady(cfg Config) (rd readiness) {
+	rd.Ready = true
+	rd.Checks = make(map[string]string)
+	fail := func(check string, msg string) {
+		rd.Ready = false
+		rd.Checks[check] = msg
+	}
+
+	// the temp file is named like the upload temp files so that deleteOld
+	// cleans it up if it is left behind
+	f, err := os.CreateTemp(cfg.ContentDirectory, "sharetemp")
+	if err != nil {
+		fail("data_dir", err.Error())
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+		rd.Checks["data_dir"] = "ok"
+	}
+
+	free, err := diskFree(cfg.ContentDirectory)
+	if err == errDiskFreeUnsupported {
+		rd.Checks["disk_free"] = "unknown"
+	} else if err != nil {
+		fail("disk_free", err.Error())
+	} else if int64(free) < cfg.MinFreeBytes {
+		fail("disk_free", HumanizeBytes(int64(free))+" free, less than "+HumanizeBytes(cfg.MinFreeBytes))
+	} else {
+		rd.Checks["disk_free"] = "ok"
+	}
+
+	if loaded, _ := pages.Loaded(); !loaded {
+		fail("index", "loading")
+	} else {
+		rd.Checks["index"] = "ok"
+	}
+
+	if isShuttingDown() {
+		fail("shutdown", "shutting down")
+	}
+	return
+}
+
+// handleReadyz handles GET /readyz, which fails with 503 while share
+// cannot take uploads.
+func handleReadyz(w http.ResponseWriter, r *http.Request) error {
+	rd := checkReady(getConfig())
+	code := http.StatusOK
+	if !rd.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	jsonResponse(w, code, rd)
+	return nil
+}
+
+// requireAdmin is the middleware that restricts a route to the admin with
+// HTTP basic authentication. The admin routes do not exist when no admin
+// password is configured.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		if cfg.AdminPassword == "" {
+			handleError(w, r, http.StatusNotFound, errNotFound)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(cfg.AdminUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(cfg.AdminPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="share admin", charset="UTF-8"`)
+			jsonResponse(w, http.StatusUnauthorized, map[string]string{"message": "Unauthorized."})
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+			// browsers send the credentials with cross-site forms too
+			jsonResponse(w, http.StatusForbidden, map[string]string{"message": "Cross-origin request refused."})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin returns whether a request comes from a page of share itself,
+// judging from the Origin (or else the Referer) header
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		// not sent by a browser
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == requestHost(r)
+}
+
+// chunkSession is a chunked upload in progress
+type chunkSession struct {
+	UUID    string    `json:"uuid"`
+	Chunks  int       `json:"chunks"`
+	Started time.Time `json:"started"`
+}
+
+// adminConfig are the settings shown to the admin. They are listed one by
+// one so that secrets like the admin password and the API tokens never end
+// up in the status.
+type adminConfig struct {
+	PublicURL            string  `json:"public_url"`
+	BasePath             string  `json:"base_path,omitempty"`
+	UserContentURL       string  `json:"user_content_url,omitempty"`
+	Port                 string  `json:"port"`
+	TLS                  bool    `json:"tls"`
+	ContentDirectory     string  `json:"content_directory"`
+	MaxBytesTotal        int64   `json:"max_bytes_total"`
+	MaxBytesPerFile      int64   `json:"max_bytes_per_file"`
+	MinutesPerGigabyte   float64 `json:"minutes_per_gigabyte"`
+	MinFreeBytes         int64   `json:"min_free_bytes"`
+	Scanning             bool    `json:"scanning"`
+	Thumbnails           bool    `json:"thumbnails"`
+	StripMetadata        bool    `json:"strip_metadata"`
+	Metrics              bool    `json:"metrics"`
+	RateUploads          string  `json:"rate_uploads,omitempty"`
+	RateDownloads        string  `json:"rate_downloads,omitempty"`
+	RateLookups          string  `json:"rate_lookups,omitempty"`
+	RateExists           string  `json:"rate_exists,omitempty"`
+	MaxConcurrentUploads int     `json:"max_concurrent_uploads"`
+	AccessLog            bool    `json:"access_log"`
+	AuditLog             bool    `json:"audit_log"`
+}
+
+// newAdminConfig returns the settings of the configuration that are shown
+// to the admin
+func newAdminConfig(cfg Config) adminConfig {
+	return adminConfig{
+		PublicURL:            cfg.PublicURL,
+		BasePath:             cfg.BasePath,
+		UserContentURL:       cfg.UserContentURL,
+		Port:                 cfg.Port,
+		TLS:                  cfg.TLSCert != "" || cfg.ACMEDomains != "",
+		ContentDirectory:     cfg.ContentDirectory,
+		MaxBytesTotal:        cfg.MaxBytesTotal,
+		MaxBytesPerFile:      cfg.MaxBytesPerFile,
+		MinutesPerGigabyte:   cfg.MinutesPerGigabyte,
+		MinFreeBytes:         cfg.MinFreeBytes,
+		Scanning:             cfg.ScanClamd != "" || cfg.ScanCommand != "",
+		Thumbnails:           cfg.Thumbnails,
+		StripMetadata:        cfg.StripMetadata,
+		Metrics:              cfg.Metrics,
+		RateUploads:          cfg.RateUploads,
+		RateDownloads:        cfg.RateDownloads,
+		RateLookups:          cfg.RateLookups,
+		RateExists:           cfg.RateExists,
+		MaxConcurrentUploads: cfg.MaxConcurrentUploads,
+		AccessLog:            cfg.AccessLog != "",
+		AuditLog:             cfg.AuditLog != "",
+	}
+}
+
+// adminStatus is the status shown to the admin
+type adminStatus struct {
+	Config           adminConfig    `json:"config"`
+	Started          time.Time      `json:"started"`
+	Uptime           string         `json:"uptime"`
+	Ready            readiness      `json:"ready"`
+	StoredBytes      int64          `json:"stored_bytes"`
+	StoredHuman      string         `json:"stored_human"`
+	MaxBytesTotal    int64          `json:"max_bytes_total"`
+	StoredPercent    float64        `json:"stored_percent"`
+	Uploads          int            `json:"uploads"`
+	TempFiles        int            `json:"temp_files"`
+	ChunkSessions    []chunkSession `json:"chunk_sessions"`
+	IndexLoaded      bool           `json:"index_loaded"`
+	LastCleanup      *time.Time     `json:"last_cleanup"`
+	LastCleanupHuman string         `json:"last_cleanup_human,omitempty"`
+}
+
+// handleAdminStatus handles GET /admin/status with the status of the
+// server for the admin
+func handleAdminStatus(w http.ResponseWriter, r *http.Request) (err error) {
+	cfg := getConfig()
+	status := adminStatus{
+		Config:        newAdminConfig(cfg),
+		Started:       startTime,
+		Uptime:        time.Since(startTime).Round(time.Second).String(),
+		Ready:         checkReady(cfg),
+		MaxBytesTotal: cfg.MaxBytesTotal,
+		Uploads:       pages.Len(),
+		ChunkSessions: []chunkSession{},
+	}
+
+	status.StoredBytes, _, err = DirSize(cfg.ContentDirectory)
+	if err != nil {
+		return
+	}
+	status.StoredHuman = HumanizeBytes(status.StoredBytes)
+	if cfg.MaxBytesTotal > 0 {
+		status.StoredPercent = 100 * float64(status.StoredBytes) / float64(cfg.MaxBytesTotal)
+	}
+
+	files, err := os.ReadDir(cfg.ContentDirectory)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "sharetemp") {
+			status.TempFiles++
+		}
+	}
+
+	uploadsLock.Lock()
+	for uuid, chunks := range uploadsInProgress {
+		status.ChunkSessions = append(status.ChunkSessions, chunkSession{UUID: uuid, Chunks: chunks, Started: uploadsStarted[uuid]})
+	}
+	uploadsLock.Unlock()
+
+	var lastCleanup time.Time
+	status.IndexLoaded, lastCleanup = pages.Loaded()
+	if !lastCleanup.IsZero() {
+		status.LastCleanup = &lastCleanup
+		status.LastCleanupHuman = HumanizeTime(lastCleanup)
+	}
+
+	jsonResponse(w, http.StatusOK, status)
+	return
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminStatusHidesSecrets(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.AdminPassword = "admin-secret"
+	cfg.APITokens = "token-secret"
+	cfg.ScanCommand = "scan --key command-secret"
+	cfg.ACMEEmail = "admin@example.com"
+	setConfig(cfg)
+	resetUploads()
+
+	w := httptest.NewRecorder()
+	assert.Nil(t, handleAdminStatus(w, httptest.NewRequest("GET", "/admin/status", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `"scanning":true`)
+	assert.Contains(t, body, `"max_bytes_per_file":100000000`)
+	for _, secret := range []string{"admin-secret", "token-secret", "command-secret", "admin@example.com"} {
+		assert.NotContains(t, body, secret)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	cfg := useTestConfig(t)
+	handler := requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name     string
+		password string
+		method   string
+		user     string
+		pass     string
+		origin   string
+		want     int
+	}{
+		{"disabled", "", "GET", "admin", "", "", http.StatusNotFound},
+		{"no credentials", "secret", "GET", "", "", "", http.StatusUnauthorized},
+		{"wrong password", "secret", "GET", "admin", "wrong", "", http.StatusUnauthorized},
+		{"admin", "secret", "GET", "admin", "secret", "", http.StatusOK},
+		{"same origin form", "secret", "POST", "admin", "secret", "http://share.example.com/admin", http.StatusOK},
+		{"cross-site form", "secret", "POST", "admin", "secret", "http://evil.example.com/", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.AdminUser = "admin"
+			cfg.AdminPassword = tt.password
+			setConfig(cfg)
+			r := httptest.NewRequest(tt.method, "http://share.example.com/admin", nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	log "github.com/schollz/logger"
+)
+
+// text previews are highlighted a page at a time, so that big files (like
+// logs) are loaded while scrolling instead of at once
+const (
+	highlightPageLines = 1000
+	highlightPageBytes = 256 * 1024
+	// pages bigger than this (e.g. minified files) are not highlighted
+	highlightMaxBytes = 2 * 1024 * 1024
+)
+
+// highlightStyle is the chroma style of the code view
+var highlightStyle = styles.Get("github")
+
+// highlightCSS is the stylesheet of the code view
+func highlightCSS() template.CSS {
+	var buf bytes.Buffer
+	err := html.New(html.WithClasses(true)).WriteCSS(&buf, highlightStyle)
+	if err != nil {
+		log.Error(err)
+	}
+	return template.CSS(buf.String())
+}
+
+// lexer chooses the syntax of the upload from its name, its content and its
+// content type
+func (p *Page) lexer() (lexer chroma.Lexer) {
+	lexer = lexers.Match(p.Name)
+	if lexer == nil {
+		if sample, err := p.readText(4096); err == nil {
+			lexer = lexers.Analyse(string(sample))
+		}
+	}
+	if lexer == nil {
+		if mediaType, _, err := mime.ParseMediaType(p.ContentType); err == nil {
+			lexer = lexers.MatchMimeType(mediaType)
+		}
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	return chroma.Coalesce(lexer)
+}
+
+// Language is the name of the syntax used to highlight the upload
+func (p *Page) Language() string {
+	return p.lexer().Config().Name
+}
+
+// readLines reads up to a page of lines of the decompressed data, starting
+// at line from (counting from 1). next is the line of the next page, or 0 if
+// this is the last one.
+func (p *Page) readLines(from int) (text string, next int, err error) {
+	rc, err := p.openData()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+
+	br := bufio.NewReader(p.decodeText(rc))
+	line := 1
+	for ; line < from; line++ {
+		if _, err = br.ReadSlice('\n'); err == bufio.ErrBufferFull {
+			// skip the rest of a long line
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+		}
+		if err == io.EOF {
+			return "", 0, nil
+		} else if err != nil {
+			return
+		}
+	}
+
+	var buf strings.Builder
+	for n := 0; n < highlightPageLines && buf.Len() < highlightPageBytes; n++ {
+		var s string
+		s, err = br.ReadString('\n')
+		buf.WriteString(s)
+		if err == io.EOF {
+			return buf.String(), 0, nil
+		} else if err != nil {
+			return
+		}
+		line++
+	}
+	if _, errPeek := br.Peek(1); errPeek == io.EOF {
+		line = 0
+	}
+	return buf.String(), line, nil
+}
+
+// highlightLines highlights a page of lines with line numbers that link to
+// themselves (#L10)
+func (p *Page) highlightLines(from int) (highlighted template.HTML, next int, err error) {
+	text, next, err := p.readLines(from)
+	if err != nil {
+		return
+	}
+	lexer := p.lexer()
+	if len(text) > highlightMaxBytes {
+		lexer = lexers.Fallback
+	}
+	iterator, err := lexer.Tokenise(nil, text)
+	if err != nil {
+		return
+	}
+	formatter := html.New(
+		html.WithClasses(true),
+		html.WithLineNumbers(true),
+		html.WithLinkableLineNumbers(true, "L"),
+		html.BaseLineNumber(from),
+	)
+	var buf bytes.Buffer
+	err = formatter.Format(&buf, highlightStyle, iterator)
+	if err != nil {
+		return
+	}
+	return template.HTML(buf.String()), next, nil
+}
+
+// handleLines handles GET /lines/<id>/<filename>?from=N and returns the
+// highlighted page of lines starting at line N, for loading the code view
+// while scrolling. The line of the next page is in the X-Next-Line header.
+func handleLines(w http.ResponseWriter, r *http.Request) (err error) {
+	p, err := loadRequestPage(r)
+	if err != nil {
+		return
+	}
+	if p.refuseUnscanned(w, r) {
+		return
+	}
+	if p.previewKind() != previewText {
+		return errNotFound
+	}
+	from, errFrom := strconv.Atoi(r.URL.Query().Get("from"))
+	if errFrom != nil || from < 1 {
+		from = 1
+	}
+	highlighted, next, err := p.highlightLines(from)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Next-Line", strconv.Itoa(next))
+	p.setUploadCacheControl(w)
+	_, err = io.WriteString(w, string(highlighted))
+	return
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadLines(t *testing.T) {
+	useTestConfig(t)
+	var lines strings.Builder
+	for i := 1; i <= 2500; i++ {
+		fmt.Fprintf(&lines, "line %d\n", i)
+	}
+	long := strings.Repeat("x", 10000) + "\nafter\n"
+	tests := []struct {
+		name      string
+		data      string
+		from      int
+		wantStart string
+		wantLines int
+		wantNext  int
+	}{
+		{"first page", lines.String(), 1, "line 1\n", highlightPageLines, highlightPageLines + 1},
+		{"second page", lines.String(), 1001, "line 1001\n", highlightPageLines, 2001},
+		{"last page", lines.String(), 2001, "line 2001\n", 500, 0},
+		{"past the end", lines.String(), 3000, "", 0, 0},
+		{"exact page", strings.Repeat("a\n", highlightPageLines), 1, "a\n", highlightPageLines, 0},
+		{"no final newline", "a\nb", 1, "a\n", 2, 0},
+		{"skips a long line", long, 2, "after\n", 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := writeTestUpload(t, "abc", "a.txt", []byte(tt.data))
+			p.ContentType = "text/plain; charset=utf-8"
+			text, next, err := p.readLines(tt.from)
+			assert.Nil(t, err)
+			assert.True(t, strings.HasPrefix(text, tt.wantStart))
+			gotLines := 0
+			if text != "" {
+				gotLines = len(strings.Split(strings.TrimSuffix(text, "\n"), "\n"))
+			}
+			assert.Equal(t, tt.wantLines, gotLines)
+			assert.Equal(t, tt.wantNext, next)
+		})
+	}
+}
+
+func TestHighlightLines(t *testing.T) {
+	useTestConfig(t)
+	p := writeTestUpload(t, "abc", "main.go", []byte("package main\n\nfunc main() {}\n"))
+	p.ContentType = "text/plain; charset=utf-8"
+	assert.Equal(t, "Go", p.Language())
+	highlighted, next, err := p.highlightLines(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, next)
+	assert.Contains(t, string(highlighted), `id="L3"`)
+	assert.Contains(t, string(highlighted), `<span class="kd">func</span>`)
+
+	// the language is guessed from the content type without a known extension
+	p = writeTestUpload(t, "def", "script", []byte("x = 1\n"))
+	p.ContentType = "text/x-python; charset=utf-8"
+	assert.Equal(t, "Python", p.Language())
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// pageIndex is an in-memory index of the metadata of all uploads. It is
+// rebuilt from the data directory on every deleteOld pass and kept up to
+// date in between as uploads are added and deleted.
+type pageIndex struct {
+	sync.RWMutex
+	pages       map[string]*Page
+	loaded      bool
+	lastCleanup time.Time
+}
+
+// pages is the index of all uploads
+var pages = &pageIndex{pages: make(map[string]*Page)}
+
+// Put adds or replaces the metadata of an upload
+func (pi *pageIndex) Put(p *Page) {
+	pi.Lock()
+	defer pi.Unlock()
+	pi.pages[p.ID] = p
+}
+
+// Delete removes an upload from the index
+func (pi *pageIndex) Delete(id string) {
+	pi.Lock()
+	defer pi.Unlock()
+	delete(pi.pages, id)
+}
+
+// Get returns the metadata of an upload, if it is in the index
+func (pi *pageIndex) Get(id string) (p *Page, ok bool) {
+	pi.RLock()
+	defer pi.RUnlock()
+	p, ok = pi.pages[id]
+	return
+}
+
+// List returns all uploads, newest first
+func (pi *pageIndex) List() (list []*Page) {
+	pi.RLock()
+	list = make([]*Page, 0, len(pi.pages))
+	for _, p := range pi.pages {
+		list = append(list, p)
+	}
+	pi.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Modified.After(list[j].Modified)
+	})
+	return
+}
+
+// Len returns the number of uploads
+func (pi *pageIndex) Len() int {
+	pi.RLock()
+	defer pi.RUnlock()
+	return len(pi.pages)
+}
+
+// Loaded returns whether the index has been built from the data directory
+// and when the last deleteOld pass finished
+func (pi *pageIndex) Loaded() (loaded bool, lastCleanup time.Time) {
+	pi.RLock()
+	defer pi.RUnlock()
+	return pi.loaded, pi.lastCleanup
+}
+
+// Replace swaps in the uploads found by a pass over the data directory that
+// started at the given time. Uploads added since then are kept.
+func (pi *pageIndex) Replace(found map[string]*Page, started time.Time) {
+	pi.Lock()
+	defer pi.Unlock()
+	for id, p := range pi.pages {
+		if _, ok := found[id]; !ok && p.Modified.After(started) {
+			found[id] = p
+		}
+	}
+	pi.pages = found
+	pi.loaded = true
+	pi.lastCleanup = time.Now()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// rotatingFile is an append-only log file that is rotated when it grows
+// beyond maxBytes. Rotated files get a timestamp suffix and only the newest
+// maxBackups are kept (all of them if maxBackups is 0).
+type rotatingFile struct {
+	sync.Mutex
+	name       string
+	maxBytes   int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// openRotatingFile opens the log file for appending
+func openRotatingFile(name string, maxBytes int64, maxBackups int) (rf *rotatingFile, err error) {
+	rf = &rotatingFile{name: name, maxBytes: maxBytes, maxBackups: maxBackups}
+	err = rf.open()
+	return
+}
+
+func (rf *rotatingFile) open() (err error) {
+	rf.f, err = os.OpenFile(rf.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return
+	}
+	info, err := rf.f.Stat()
+	if err != nil {
+		return
+	}
+	rf.size = info.Size()
+	return
+}
+
+// Write appends to the log file, rotating it first if needed
+func (rf *rotatingFile) Write(b []byte) (n int, err error) {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.maxBytes > 0 && rf.size > 0 && rf.size+int64(len(b)) > rf.maxBytes {
+		if err = rf.rotate(); err != nil {
+			return
+		}
+	}
+	n, err = rf.f.Write(b)
+	rf.size += int64(n)
+	return
+}
+
+// rotate moves the current log file aside and starts a new one. If the
+// file cannot be moved, logging goes on in the current file and rotating
+// is tried again after another maxBytes.
+func (rf *rotatingFile) rotate() (err error) {
+	rf.f.Close()
+	err = os.Rename(rf.name, rf.name+"."+time.Now().UTC().Format("20060102T150405.000000000"))
+	if err != nil {
+		log.Errorf("could not rotate log %s: %s", rf.name, err.Error())
+		err = rf.open()
+		rf.size = 0
+		return
+	}
+	if rf.maxBackups > 0 {
+		backups, _ := filepath.Glob(rf.name + ".*")
+		sort.Strings(backups)
+		for len(backups) > rf.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return rf.open()
+}
+
+// Reopen closes and opens the log file again, for when it was moved away
+// by an external tool such as logrotate
+func (rf *rotatingFile) Reopen() error {
+	rf.Lock()
+	defer rf.Unlock()
+	rf.f.Close()
+	return rf.open()
+}
+
+// jsonLogger writes one JSON object per line
+type jsonLogger struct {
+	w *rotatingFile
+}
+
+// Log writes the entry as a line of JSON
+func (l *jsonLogger) Log(entry interface{}) {
+	if l == nil {
+		return
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if _, err = l.w.Write(append(b, '\n')); err != nil {
+		log.Errorf("could not write log %s: %s", l.w.name, err.Error())
+	}
+}
+
+// accessLog records every request, auditLog records the lifecycle of the
+// uploads. They are nil when disabled.
+var accessLog, auditLog *jsonLogger
+
+// setupLogs opens the access and audit logs that are configured. The audit
+// log keeps its own number of backups, all of them by default, so that it
+// can be retained.
+func setupLogs(cfg Config) (err error) {
+	open := func(name string, maxBackups int) (l *jsonLogger, err error) {
+		if name == "" {
+			return
+		}
+		rf, err := openRotatingFile(name, cfg.LogMaxBytes, maxBackups)
+		if err != nil {
+			return
+		}
+		return &jsonLogger{w: rf}, nil
+	}
+	accessLog, err = open(cfg.AccessLog, cfg.LogMaxBackups)
+	if err != nil {
+		return
+	}
+	auditLog, err = open(cfg.AuditLog, cfg.AuditLogMaxBackups)
+	return
+}
+
+// reopenLogs reopens the access and audit logs
+func reopenLogs() {
+	for _, l := range []*jsonLogger{accessLog, auditLog} {
+		if l == nil {
+			continue
+		}
+		if err := l.w.Reopen(); err != nil {
+			log.Errorf("could not reopen log %s: %s", l.w.name, err.Error())
+		}
+	}
+}
+
+// accessLogEntry is a line of the access log
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"client_ip"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Route      string    `json:"route,omitempty"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Referer    string    `json:"referer,omitempty"`
+	ShareID    string    `json:"share_id,omitempty"`
+}
+
+// audit events
+const (
+	auditEventUpload     = "upload"
+	auditEventDownload   = "download"
+	auditEventDelete     = "delete"
+	auditEventExpire     = "expire"
+	auditEventTrim       = "trim"
+	auditEventExtend     = "extend"
+	auditEventBlock      = "block"
+	auditEventUnblock    = "unblock"
+	auditEventReport     = "report"
+	auditEventQuarantine = "quarantine"
+)
+
+// auditLogEntry is a line of the audit log
+type auditLogEntry struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	ShareID   string    `json:"share_id"`
+	Name      string    `json:"name,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// requestInfo holds information that handlers learn about a request, so
+// that it can be logged afterwards.
+type requestInfo struct {
+	ShareID string
+}
+
+// setRequestShareID records which share a request was about
+func setRequestShareID(r *http.Request, id string) {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		info.ShareID = id
+	}
+}
+
+// requestShareID returns which share a request was about
+func requestShareID(r *http.Request) string {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok && info.ShareID != "" {
+		return info.ShareID
+	}
+	return routeParam(r, "id")
+}
+
+// auditRequest records an event for a share caused by a request
+func auditRequest(r *http.Request, event string, p *Page) {
+	setRequestShareID(r, p.ID)
+	auditLog.Log(auditLogEntry{
+		Time:      time.Now().UTC(),
+		Event:     event,
+		ShareID:   p.ID,
+		Name:      p.Name,
+		Size:      p.Size,
+		Hash:      p.Hash,
+		ClientIP:  clientIP(r),
+		UserAgent: r.UserAgent(),
+	})
+}
+
+// auditUpload records a finished upload, given the "<id>/<name>" it was
+// stored as
+func auditUpload(r *http.Request, fnameFull string) {
+	p, err := loadPageInfo(path.Dir(fnameFull))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	auditRequest(r, auditEventUpload, p)
+}
+
+// auditCleanup records a share that was removed by the server
+func auditCleanup(event string, p *Page) {
+	auditLog.Log(auditLogEntry{
+		Time:    time.Now().UTC(),
+		Event:   event,
+		ShareID: p.ID,
+		Name:    p.Name,
+		Size:    p.Size,
+		Hash:    p.Hash,
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxBytes    int64
+		maxBackups  int
+		writes      int
+		wantBackups int
+	}{
+		{"no rotation", 0, 0, 10, 0},
+		{"under the limit", 100, 0, 10, 0},
+		{"rotated", 25, 0, 10, 3},
+		{"backups trimmed", 25, 2, 10, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "access.log")
+			rf, err := openRotatingFile(name, tt.maxBytes, tt.maxBackups)
+			assert.Nil(t, err)
+			for i := 0; i < tt.writes; i++ {
+				n, err := rf.Write([]byte("a line\n"))
+				assert.Nil(t, err)
+				assert.Equal(t, 7, n)
+			}
+			rf.f.Close()
+			backups, _ := filepath.Glob(name + ".*")
+			assert.Len(t, backups, tt.wantBackups)
+			for _, fname := range append(backups, name) {
+				info, err := os.Stat(fname)
+				assert.Nil(t, err)
+				if tt.maxBytes > 0 {
+					assert.LessOrEqual(t, info.Size(), tt.maxBytes)
+				}
+			}
+		})
+	}
+}
+
+func TestRotatingFileRenameError(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	rf, err := openRotatingFile(name, 10, 0)
+	assert.Nil(t, err)
+	_, err = rf.Write([]byte("first\n"))
+	assert.Nil(t, err)
+	// the file cannot be renamed once it is gone
+	assert.Nil(t, os.Remove(name))
+	_, err = rf.Write([]byte("second\n"))
+	assert.Nil(t, err)
+	rf.f.Close()
+	b, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	assert.Equal(t, "second\n", string(b))
+	backups, _ := filepath.Glob(name + ".*")
+	assert.Empty(t, backups)
+}
+
+func TestJSONLogger(t *testing.T) {
+	var l *jsonLogger
+	l.Log(auditLogEntry{Event: auditEventUpload})
+
+	name := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := openRotatingFile(name, 0, 0)
+	assert.Nil(t, err)
+	l = &jsonLogger{w: rf}
+	l.Log(auditLogEntry{Event: auditEventUpload, ShareID: "abc"})
+	l.Log(auditLogEntry{Event: auditEventDelete, ShareID: "abc"})
+	rf.f.Close()
+
+	b, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 2)
+	var entry auditLogEntry
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, auditEventDelete, entry.Event)
+	assert.Equal(t, "abc", entry.ShareID)
+}
+
+func TestSetupLogsBackups(t *testing.T) {
+	defer func(access, audit *jsonLogger) {
+		accessLog, auditLog = access, audit
+	}(accessLog, auditLog)
+	dir := t.TempDir()
+	cfg := Config{
+		AccessLog:          filepath.Join(dir, "access.log"),
+		AuditLog:           filepath.Join(dir, "audit.log"),
+		LogMaxBytes:        10,
+		LogMaxBackups:      2,
+		AuditLogMaxBackups: 0,
+	}
+	assert.Nil(t, setupLogs(cfg))
+	for i := 0; i < 10; i++ {
+		accessLog.Log(map[string]int{"n": i})
+		auditLog.Log(map[string]int{"n": i})
+	}
+	accessLog.w.f.Close()
+	auditLog.w.f.Close()
+	backups, _ := filepath.Glob(cfg.AccessLog + ".*")
+	assert.Len(t, backups, 2)
+	// the audit log keeps all of them
+	backups, _ = filepath.Glob(cfg.AuditLog + ".*")
+	assert.Len(t, backups, 9)
+}
@@ -16,7 +16,10 @@ import (
 
 	"math"
 	"math/rand"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -25,12 +28,11 @@ import (
 	"strings"
 	"sync"
 	"time"
-	"unicode"
 
 	"github.com/avct/uasurfer"
-	"github.com/h2non/filetype"
 	"github.com/hako/durafmt"
 	log "github.com/schollz/logger"
+	"golang.org/x/crypto/acme"
 )
 
 // content holds our static web server content.
@@ -38,9 +40,6 @@ import (
 //go:embed static/*
 var content embed.FS
 
-// global config
-var c Config
-
 // Config contains all the configurable parameters
 // for the server
 type Config struct {
@@ -52,12 +51,112 @@ type Config struct {
 	MaxBytesPerFile      int64
 	MaxBytesPerFileHuman string
 	MinutesPerGigabyte   float64
+	ShutdownSeconds      int
+
+	// TLS settings
+	TLSCert            string
+	TLSKey             string
+	ACMEDomains        string
+	ACMEEmail          string
+	ACMEDirectory      string
+	ACMECARoot         string
+	ACMECacheDirectory string
+	HTTPPort           string
+	HSTSSeconds        int
+
+	// reverse proxy settings
+	BasePath       string
+	TrustedProxies string
+	trustedProxies []*net.IPNet
+	publicURLSet   bool
+
+	// UserContentURL is a separate origin for the data of uploads, like
+	// https://usercontent.example.com, so that uploads can not reach the
+	// pages of share
+	UserContentURL  string
+	userContentHost string
+
+	// CORSOrigins are the origins allowed to make cross-origin requests
+	CORSOrigins string
+
+	// ClientOverrides decide the response (raw, view or json) for
+	// User-Agents that are not handled well by content negotiation
+	ClientOverrides string
+
+	// Metrics enables the Prometheus /metrics endpoint
+	Metrics bool
+
+	// MinFreeBytes is the free disk space below which share is not ready
+	MinFreeBytes int64
+
+	// admin credentials, the admin pages are disabled without a password
+	AdminUser     string
+	AdminPassword string
+
+	// malware scanning with clamd or a command, infected uploads are moved
+	// to the quarantine directory
+	ScanClamd           string
+	ScanCommand         string
+	ScanTimeoutSeconds  int
+	QuarantineDirectory string
+
+	// thumbnails of images, and posters of videos if ffmpeg is set
+	Thumbnails      bool
+	ThumbnailFFmpeg string
+
+	// VariantCacheBytes is how many bytes of resized images are kept for
+	// all uploads together
+	VariantCacheBytes int64
+
+	// StripMetadata strips Exif and other metadata from all image uploads,
+	// instead of only when the uploader asks for it
+	StripMetadata bool
+
+	// rate limits per client, like "30/m", and the API tokens whose clients
+	// are limited by token instead of by IP
+	RateUploads          string
+	RateDownloads        string
+	RateLookups          string
+	RateExists           string
+	RateReports          string
+	MaxConcurrentUploads int
+	APITokens            string
+	rateUploads          rateSpec
+	rateDownloads        rateSpec
+	rateLookups          rateSpec
+	rateExists           rateSpec
+	rateReports          rateSpec
+
+	// bandwidth limits in bytes per second for each connection, for each
+	// connection with an API token and for all connections together
+	DownloadBytesPerSecond      int64
+	DownloadBytesPerSecondAuth  int64
+	DownloadBytesPerSecondTotal int64
+	UploadBytesPerSecond        int64
+	UploadBytesPerSecondAuth    int64
+	UploadBytesPerSecondTotal   int64
+
+	// content types: a mime.types file of extensions that overrides the
+	// built-in ones, and the types that uploaders can declare
+	MimeTypes     string
+	DeclaredTypes string
+	mimeTypes     map[string]string
+	declaredTypes []string
+
+	// log settings
+	AccessLog          string
+	AuditLog           string
+	LogMaxBytes        int64
+	LogMaxBackups      int
+	AuditLogMaxBackups int
 }
 
 // uploads keep track of parallel chunking
 var uploadsLock sync.Mutex
 var uploadsInProgress map[string]int
 var uploadsFileNames map[string]string
+var uploadsStarted map[string]time.Time
+var uploadsClients map[string]string
 var uploadsHashLock sync.Mutex
 var uploadsHash map[string]string
 
@@ -66,70 +165,99 @@ var indexTemplate *template.Template
 
 func main() {
 	// flag ariables
-	flag.StringVar(&c.ContentDirectory, "data", "data", "data directory")
-	flag.StringVar(&c.PublicURL, "public", "", "public URL to use")
-	flag.StringVar(&c.Port, "port", "8222", "port to use")
-	flag.BoolVar(&c.Debug, "debug", false, "debug mode")
-	flag.Int64Var(&c.MaxBytesPerFile, "max-file", 100000000, "max bytes per file")
-	flag.Int64Var(&c.MaxBytesTotal, "max-total", 10000000000, "max bytes total")
-	flag.Float64Var(&c.MinutesPerGigabyte, "min-per-gig", 30, "number of minutes per gigabyte to scale auto-deletion")
+	flag.StringVar(&configFile, "config", "", "JSON config file (reloaded on SIGHUP)")
+	flag.StringVar(&flagConfig.ContentDirectory, "data", "data", "data directory")
+	flag.StringVar(&flagConfig.PublicURL, "public", "", "public URL to use")
+	flag.StringVar(&flagConfig.Port, "port", "8222", "port to use")
+	flag.BoolVar(&flagConfig.Debug, "debug", false, "debug mode")
+	flag.Int64Var(&flagConfig.MaxBytesPerFile, "max-file", 100000000, "max bytes per file")
+	flag.Int64Var(&flagConfig.MaxBytesTotal, "max-total", 10000000000, "max bytes total")
+	flag.Float64Var(&flagConfig.MinutesPerGigabyte, "min-per-gig", 30, "number of minutes per gigabyte to scale auto-deletion")
+	flag.IntVar(&flagConfig.ShutdownSeconds, "shutdown-timeout", 60, "seconds to wait for uploads to finish when shutting down")
+	flag.StringVar(&flagConfig.TLSCert, "tls-cert", "", "TLS certificate file (enables HTTPS)")
+	flag.StringVar(&flagConfig.TLSKey, "tls-key", "", "TLS key file")
+	flag.StringVar(&flagConfig.ACMEDomains, "acme", "", "comma-separated domains to get certificates for automatically (enables HTTPS)")
+	flag.StringVar(&flagConfig.ACMEEmail, "acme-email", "", "contact email for the ACME account")
+	flag.StringVar(&flagConfig.ACMEDirectory, "acme-directory", acme.LetsEncryptURL, "ACME directory URL")
+	flag.StringVar(&flagConfig.ACMECARoot, "acme-ca", "", "CA certificate to trust for the ACME directory (e.g. for Pebble)")
+	flag.StringVar(&flagConfig.ACMECacheDirectory, "acme-cache", "certs", "directory to store ACME certificates")
+	flag.StringVar(&flagConfig.HTTPPort, "http-port", "", "port for plain HTTP redirects to HTTPS (and ACME challenges)")
+	flag.IntVar(&flagConfig.HSTSSeconds, "hsts", 31536000, "max-age of the HSTS header when using HTTPS (0 to disable)")
+	flag.StringVar(&flagConfig.BasePath, "base-path", "", "path prefix that share is served under (e.g. /share)")
+	flag.BoolVar(&flagConfig.Metrics, "metrics", false, "serve Prometheus metrics on /metrics")
+	flag.StringVar(&flagConfig.ClientOverrides, "client-overrides", "", "comma-separated User-Agent substrings and the response they get, e.g. 'httpie=raw,powershell=raw'")
+	flag.StringVar(&flagConfig.CORSOrigins, "cors", "", "comma-separated origins allowed to make cross-origin requests (* for any)")
+	flag.StringVar(&flagConfig.TrustedProxies, "trusted-proxies", "", "comma-separated IPs/CIDRs of proxies whose X-Forwarded-*/Forwarded headers are trusted")
+	flag.StringVar(&flagConfig.AccessLog, "access-log", "", "file for the JSON access log")
+	flag.StringVar(&flagConfig.AuditLog, "audit-log", "", "file for the JSON audit log of uploads, downloads and deletions")
+	flag.Int64Var(&flagConfig.LogMaxBytes, "log-max-size", 100000000, "max bytes of a log file before it is rotated (0 to disable)")
+	flag.IntVar(&flagConfig.LogMaxBackups, "log-max-backups", 10, "number of rotated access log files to keep (0 to keep all)")
+	flag.IntVar(&flagConfig.AuditLogMaxBackups, "audit-log-max-backups", 0, "number of rotated audit log files to keep (0 to keep all)")
+	flag.Int64Var(&flagConfig.MinFreeBytes, "min-free", 100000000, "free bytes on the data disk below which /readyz fails")
+	flag.StringVar(&flagConfig.AdminUser, "admin-user", "admin", "user name for the admin pages")
+	flag.StringVar(&flagConfig.AdminPassword, "admin-password", "", "password for the admin pages (disabled if empty, or set ADMIN_PASSWORD)")
+	flag.StringVar(&flagConfig.ScanClamd, "scan-clamd", "", "clamd socket to scan uploads with (unix:/path or tcp:host:port)")
+	flag.StringVar(&flagConfig.ScanCommand, "scan-command", "", "command that scans uploads from stdin, exiting with 1 if infected (e.g. 'clamdscan --no-summary -')")
+	flag.IntVar(&flagConfig.ScanTimeoutSeconds, "scan-timeout", 300, "seconds to wait for a scan")
+	flag.StringVar(&flagConfig.QuarantineDirectory, "quarantine", "quarantine", "directory for infected uploads (outside the data directory)")
+	flag.StringVar(&flagConfig.RateUploads, "rate-uploads", "20/m", "uploads per client (e.g. 20/m, 0 for no limit)")
+	flag.StringVar(&flagConfig.RateDownloads, "rate-downloads", "600/m", "downloads per client")
+	flag.StringVar(&flagConfig.RateLookups, "rate-lookups", "30/m", "lookups of IDs that do not exist per client")
+	flag.StringVar(&flagConfig.RateExists, "rate-exists", "120/m", "/exists requests per client")
+	flag.StringVar(&flagConfig.RateReports, "rate-reports", "10/h", "reports of files per client")
+	flag.IntVar(&flagConfig.MaxConcurrentUploads, "max-concurrent-uploads", 4, "uploads in progress per client (0 for no limit)")
+	flag.StringVar(&flagConfig.APITokens, "api-tokens", "", "comma-separated API tokens (sent as 'Authorization: Bearer <token>'), rate limited per token instead of per IP")
+	flag.Int64Var(&flagConfig.DownloadBytesPerSecond, "download-bps", 0, "bytes per second for each download (0 for no limit)")
+	flag.Int64Var(&flagConfig.DownloadBytesPerSecondAuth, "download-bps-auth", 0, "bytes per second for each download with an API token (0 for no limit of its own, the total limit still applies)")
+	flag.Int64Var(&flagConfig.DownloadBytesPerSecondTotal, "download-bps-total", 0, "bytes per second for all downloads together (0 for no limit)")
+	flag.Int64Var(&flagConfig.UploadBytesPerSecond, "upload-bps", 0, "bytes per second for each upload (0 for no limit)")
+	flag.Int64Var(&flagConfig.UploadBytesPerSecondAuth, "upload-bps-auth", 0, "bytes per second for each upload with an API token (0 for no limit of its own, the total limit still applies)")
+	flag.Int64Var(&flagConfig.UploadBytesPerSecondTotal, "upload-bps-total", 0, "bytes per second for all uploads together (0 for no limit)")
+	flag.BoolVar(&flagConfig.Thumbnails, "thumbnails", true, "make thumbnails of images")
+	flag.StringVar(&flagConfig.ThumbnailFFmpeg, "thumbnail-ffmpeg", "", "path to ffmpeg for making posters of videos")
+	flag.Int64Var(&flagConfig.VariantCacheBytes, "variant-cache-size", 500000000, "bytes of resized images to keep for all uploads together (0 for no limit)")
+	flag.BoolVar(&flagConfig.StripMetadata, "strip-metadata", false, "strip location, camera and other metadata from all JPEG, PNG and WebP uploads")
+	flag.StringVar(&flagConfig.UserContentURL, "usercontent-url", "", "separate URL (on another domain) to serve the data of uploads from")
+	flag.StringVar(&flagConfig.MimeTypes, "mime-types", "", "mime.types file with the content types of extensions")
+	flag.StringVar(&flagConfig.DeclaredTypes, "declared-types", defaultDeclaredTypes, "comma-separated content types that uploaders can declare (e.g. image/*)")
 	flag.Parse()
 
-	if dataDirEnv := os.Getenv("DATA_DIR"); os.Getenv("DATA_DIR") != "" {
-		c.ContentDirectory = dataDirEnv
-	}
-	if publicUrlEnv := os.Getenv("PUBLIC_URL"); os.Getenv("PUBLIC_URL") != "" {
-		c.PublicURL = publicUrlEnv
-	}
-	if portEnv := os.Getenv("PORT"); os.Getenv("PORT") != "" {
-		c.Port = portEnv
-	}
-	if debugEnv := os.Getenv("DEBUG"); os.Getenv("DEBUG") != "" {
-		debug, err := strconv.ParseBool(debugEnv)
-		if err != nil {
-			panic(err)
-		}
-		c.Debug = debug
-	}
-	if maxFileBytesEnv := os.Getenv("MAX_FILE_BYTES"); os.Getenv("MAX_FILE_BYTES") != "" {
-		maxFileBytes, err := strconv.ParseInt(maxFileBytesEnv, 10, 64)
-		if err != nil {
-			panic(err)
-		}
-		c.MaxBytesPerFile = maxFileBytes
-	}
-	if maxTotalBytesEnv := os.Getenv("MAX_TOTAL_BYTES"); os.Getenv("MAX_TOTAL_BYTES") != "" {
-		maxTotalBytes, err := strconv.ParseInt(maxTotalBytesEnv, 10, 64)
-		if err != nil {
-			panic(err)
-		}
-		c.MaxBytesTotal = maxTotalBytes
+	// initialize config
+	cfg, err := loadConfig()
+	if err != nil {
+		panic(err)
 	}
-	if minPerGigEnv := os.Getenv("MIN_PER_GIG"); os.Getenv("MIN_PER_GIG") != "" {
-		minPerGig, err := strconv.ParseFloat(minPerGigEnv, 64)
-		if err != nil {
-			panic(err)
-		}
-		c.MinutesPerGigabyte = minPerGig
+	finalizeConfig(&cfg)
+	setConfig(cfg)
+	if !cfg.publicURLSet && len(cfg.trustedProxies) == 0 {
+		log.Warnf("no public URL set, links will point to %s (set -public)", cfg.PublicURL)
 	}
 
 	// set a random seed for random activities
 	rand.Seed(time.Now().UnixNano())
 
 	// set debugging
-	if c.Debug {
-		log.SetLevel("debug")
-	} else {
-		log.SetLevel("info")
+	setLogLevel(cfg)
+
+	// open the access and audit logs
+	err = setupLogs(cfg)
+	if err != nil {
+		panic(err)
 	}
 
 	// initialize chunking maps
 	uploadsInProgress = make(map[string]int)
 	uploadsFileNames = make(map[string]string)
+	uploadsStarted = make(map[string]time.Time)
+	uploadsClients = make(map[string]string)
 	uploadsHash = make(map[string]string)
 
 	// initialize home page
-	indexTemplate = template.New("basic")
+	err = loadStaticHashes()
+	if err != nil {
+		panic(err)
+	}
+	indexTemplate = template.New("basic").Funcs(template.FuncMap{"static": staticURL, "highlightCSS": highlightCSS})
 	b, err := content.ReadFile("static/index.html")
 	if err != nil {
 		panic(err)
@@ -138,50 +266,107 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	b, err = content.ReadFile("static/admin.html")
+	if err != nil {
+		panic(err)
+	}
+	adminTemplate, err = template.New("admin").Funcs(template.FuncMap{"static": staticURL}).Parse(string(b))
+	if err != nil {
+		panic(err)
+	}
 
-	// initialize config
-	c.MaxBytesPerFileHuman = HumanizeBytes(c.MaxBytesPerFile)
-	if c.PublicURL == "" {
-		c.PublicURL = "http://localhost:" + c.Port
+	os.Mkdir(cfg.ContentDirectory, os.ModePerm)
+
+	// reload the config on SIGHUP
+	watchConfigReload()
+
+	// forget clients that are no longer rate limited
+	go evictIdleLimiters()
+
+	// load the hashes that may not be uploaded
+	err = loadBlocklist()
+	if err != nil {
+		panic(err)
+	}
+
+	// load the moderation queue
+	err = loadReports()
+	if err != nil {
+		panic(err)
+	}
+
+	// restore chunked uploads that were interrupted by a restart
+	err = loadUploadSessions()
+	if err != nil {
+		log.Errorf("could not restore incomplete uploads: %s", err.Error())
 	}
-	os.Mkdir(c.ContentDirectory, os.ModePerm)
 
 	// go routine for deleting old files
+	stopCleanup := make(chan struct{})
+	cleanupDone := make(chan struct{})
 	go func() {
+		defer close(cleanupDone)
 		deleteOld(true)
 		TrimContent()
 		for {
 			deleteOld()
-			time.Sleep(30 * time.Minute)
+			select {
+			case <-stopCleanup:
+				return
+			case <-time.After(30 * time.Minute):
+			}
 		}
 	}()
 
 	// start server
-	log.Infof("Running on port %s", c.Port)
-	http.HandleFunc("/", handler)
-	http.ListenAndServe(":"+c.Port, nil)
+	tlsConfig, httpHandler, err := setupTLS(cfg)
+	if err != nil {
+		panic(err)
+	}
+	rt := newRouter()
+	server := &http.Server{Addr: ":" + cfg.Port, Handler: rt, TLSConfig: tlsConfig}
+	var redirectServer *http.Server
+	if tlsConfig != nil {
+		server.Handler = withHSTS(rt)
+		if cfg.HTTPPort != "" {
+			redirectServer = &http.Server{Addr: ":" + cfg.HTTPPort, Handler: httpHandler}
+		}
+		log.Infof("Running on port %s (HTTPS)", cfg.Port)
+	} else {
+		log.Infof("Running on port %s", cfg.Port)
+	}
+	serveUntilShutdown(server, redirectServer, stopCleanup, cleanupDone)
 }
 
 // deleteOld goes through the files and deletes old uploads
 func deleteOld(removeTempFiles ...bool) {
-	dirSize, _, err := DirSize(c.ContentDirectory)
+	cfg := getConfig()
+	started := time.Now()
+	dirSize, _, err := DirSize(cfg.ContentDirectory)
 	if err != nil {
 		log.Error(err)
 	}
+	metricStoredBytes.Set(float64(dirSize))
+	expireUploadSessions()
 
 	// find all the meta informaiton
-	files, err := os.ReadDir(c.ContentDirectory)
+	files, err := os.ReadDir(cfg.ContentDirectory)
 	if err != nil {
 		log.Error(err)
 		return
 	}
 	log.Debugf("found %d files, total %s", len(files), HumanizeBytes(dirSize))
 
-	// go through each of the meta information files
+	// go through each of the meta information files, indexing the ones
+	// that are kept
+	found := make(map[string]*Page)
+	defer func() {
+		pages.Replace(found, started)
+	}()
 	for _, f := range files {
 		if strings.HasPrefix(f.Name(), "sharetemp") {
-			if len(removeTempFiles) > 0 && removeTempFiles[0] {
-				err := os.Remove(path.Join(c.ContentDirectory, f.Name()))
+			if len(removeTempFiles) > 0 && removeTempFiles[0] && !isUploadSessionFile(f.Name()) {
+				err := os.Remove(path.Join(cfg.ContentDirectory, f.Name()))
 				if err != nil {
 					log.Errorf("problem removing temp file: %s", f.Name())
 				}
@@ -195,14 +380,34 @@ func deleteOld(removeTempFiles ...bool) {
 			log.Debugf("skipping %s: %s", id, err.Error())
 			continue
 		}
+		if blocklist.IsBlocked(p.Hash) {
+			log.Infof("deleting blocked %s (%s)", p.ID, p.Hash)
+			err = removeUpload(p.ID)
+			if err != nil {
+				log.Error(err)
+			} else {
+				observeDeletion(deletionBlocked)
+				auditCleanup(auditEventDelete, p)
+			}
+			continue
+		}
 		if time.Since(p.Modified).Seconds() < p.TimeToDeletion.Seconds() {
 			log.Debugf("skipping %s %s: not old enough (< %s)", time.Since(p.Modified).String(), id, p.TimeToDeletion.String())
+			found[p.ID] = p
+			if p.Scanning() || p.ScanFailed() {
+				// e.g. interrupted by a restart
+				startScan(p)
+			}
+			startThumbnail(p)
 			continue
 		}
 		log.Debugf("deleting %s (%s, %s)", p.ID, p.SizeHuman, p.ModifiedHuman)
-		err = os.RemoveAll(path.Join(c.ContentDirectory, p.ID))
+		err = removeUpload(p.ID)
 		if err != nil {
 			log.Error(err)
+		} else {
+			observeDeletion(deletionExpired)
+			auditCleanup(auditEventExpire, p)
 		}
 	}
 }
@@ -210,6 +415,7 @@ func deleteOld(removeTempFiles ...bool) {
 // TrimContent will continually purge things from the content directory until
 // the content directoyr is below the specified size
 func TrimContent() {
+	cfg := getConfig()
 	i := 0
 	for {
 		i++
@@ -217,20 +423,28 @@ func TrimContent() {
 			// avoid the infinite loop
 			break
 		}
-		dirSize, biggestFileID, err := DirSize(c.ContentDirectory)
+		dirSize, biggestFileID, err := DirSize(cfg.ContentDirectory)
 		if err != nil {
 			log.Error(err)
 		}
-		if dirSize < c.MaxBytesTotal || biggestFileID == "" {
+		if dirSize < cfg.MaxBytesTotal || biggestFileID == "" {
 			break
 		}
-		log.Debugf("bytes in directory exceeds max %d > %d", dirSize, c.MaxBytesTotal)
+		log.Debugf("bytes in directory exceeds max %d > %d", dirSize, cfg.MaxBytesTotal)
 		log.Debugf("removing %s", biggestFileID)
-		os.RemoveAll(path.Join(c.ContentDirectory, biggestFileID))
+		p, err := loadPageInfo(biggestFileID)
+		if err != nil {
+			p = &Page{ID: biggestFileID}
+		}
+		removeUpload(biggestFileID)
+		pages.Delete(biggestFileID)
+		observeDeletion(deletionTrimmed)
+		auditCleanup(auditEventTrim, p)
 	}
 }
 
-// DirSize returns the size of a directory in bytes
+// DirSize returns the size of a directory in bytes, and the ID of the
+// biggest upload in it, without the variants of images
 func DirSize(path string) (int64, string, error) {
 	var size int64
 	biggestFileID := ""
@@ -240,10 +454,17 @@ func DirSize(path string) (int64, string, error) {
 			return err
 		}
 		if !info.IsDir() {
+			rel, errRel := filepath.Rel(path, pathName)
+			parts := strings.Split(filepath.ToSlash(rel), "/")
+			if len(parts) == 2 && isVariantFile(parts[0], parts[1]) {
+				// variants have a limit of their own
+				return nil
+			}
 			size += info.Size()
-			if info.Size() > biggestFileSize {
-				pathName = filepath.ToSlash(pathName)
-				biggestFileID = strings.Split(pathName, "/")[1]
+			// only uploads (in the ID directories) can be trimmed, not the
+			// files of share itself
+			if errRel == nil && len(parts) > 1 && info.Size() > biggestFileSize {
+				biggestFileID = parts[0]
 				biggestFileSize = info.Size()
 			}
 		}
@@ -252,43 +473,42 @@ func DirSize(path string) (int64, string, error) {
 	return size, biggestFileID, err
 }
 
-// handler is the main handler for all requests
-func handler(w http.ResponseWriter, r *http.Request) {
-	t := time.Now().UTC()
-	err := handle(w, r)
-	if err != nil {
-		// an error has occured. return the home page if using a browser,
-		// otherwise return a JSON response
-		ua := uasurfer.Parse(r.Header.Get("User-Agent"))
-		if ua.Browser.Name == uasurfer.BrowserUnknown {
-			jsonResponse(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
-		} else {
-			p := NewPage()
-			p.Error = err.Error()
-			p.handleGetHome(w, r)
-		}
-	}
-	log.Infof("%v %v %v %s", r.RemoteAddr, r.Method, r.URL.Path, time.Since(t))
-}
-
 // Page defines content that is available to each page
 type Page struct {
 	// properties of the file
-	ID            string
-	Name          string
-	PathToFile    string
-	Hash          string
-	Link          string
-	Size          int64
-	SizeHuman     string
-	ContentType   string
-	Modified      time.Time
-	ModifiedHuman string
-	IsImage       bool
-	IsText        bool
-	IsAudio       bool
-	IsVideo       bool
-	IsASCII       bool
+	ID          string
+	Name        string
+	PathToFile  string
+	Hash        string
+	Link        string
+	Size        int64
+	SizeHuman   string
+	ContentType string
+	// DetectedContentType is the content type from the data and
+	// DeclaredContentType the one that the uploader sent
+	DetectedContentType string `json:",omitempty"`
+	DeclaredContentType string `json:",omitempty"`
+	Modified            time.Time
+	ModifiedHuman       string
+	IsImage             bool
+	IsText              bool
+	IsAudio             bool
+	IsVideo             bool
+	// IsASCII is whether the file is text (UTF-8 or UTF-16, despite the
+	// name)
+	IsASCII bool
+
+	// Uploader is the IP of the client that uploaded the file
+	Uploader string
+	// Extension is extra time before deletion given by an admin
+	Extension time.Duration
+	// ScanStatus is the result of the malware scan, if enabled
+	ScanStatus    string `json:",omitempty"`
+	ScanSignature string `json:",omitempty"`
+	// Thumbnail is whether a thumbnail of the image or video was made
+	Thumbnail string `json:",omitempty"`
+	// Sanitized is whether the metadata of the image was stripped
+	Sanitized bool `json:",omitempty"`
 
 	// computed properties
 	NameOnDisk          string
@@ -296,19 +516,25 @@ type Page struct {
 	TimeToDeletion      time.Duration
 	TimeToDeletionHuman string
 
+	// preview of the file, see preview.go
+	Preview  string        `json:"-"`
+	HTML     template.HTML `json:"-"`
+	HexDump  string        `json:"-"`
+	NextLine int           `json:"-"`
+
 	// page specific info
 	Key       string
 	Error     string
 	UserAgent *uasurfer.UserAgent
 
-	// Config data
-	Config Config
+	// Config data (not stored with the upload)
+	Config Config `json:"-"`
 }
 
 // NewPage returns a new page
 func NewPage() (p *Page) {
 	p = new(Page)
-	p.Config = c
+	p.Config = getConfig()
 	return
 }
 
@@ -320,57 +546,119 @@ func (p *Page) handlePut(w http.ResponseWriter, r *http.Request) (err error) {
 		err = fmt.Errorf("No filename provided.")
 		return err
 	}
-	p.Name, err = writeAllBytes(fname, r.Body)
+	start := time.Now()
+	throttleUpload(r)
+	body := &countingReader{Reader: r.Body}
+	p.Name, err = writeAllBytes(fname, body, uploadOptions{Uploader: clientIP(r), ContentType: r.Header.Get("Content-Type"), StripMetadata: stripRequested(r)})
 	if err != nil {
 		return
 	}
-	fmt.Fprint(w, c.PublicURL+"/"+p.Name+"\n")
+	observeUpload(uploadMethodPut, body.N, start)
+	auditUpload(r, p.Name)
+	fmt.Fprint(w, p.Config.PublicURL+"/"+p.Name+"\n")
 	return nil
 }
 
+// upload form limits, for the fields that are sent before the file
+const (
+	uploadFormMaxFields     = 32
+	uploadFormMaxFieldBytes = 1024
+)
+
+// readUploadForm reads the fields of a browser upload up to the file, which
+// Dropzone sends last, so that the upload can be refused before its data
+// is read
+func readUploadForm(r *http.Request) (fields url.Values, file *multipart.Part, err error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return
+	}
+	fields = url.Values{}
+	for i := 0; i < uploadFormMaxFields; i++ {
+		part, errPart := mr.NextPart()
+		if errPart != nil {
+			return nil, nil, fmt.Errorf("No file provided.")
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			return fields, part, nil
+		}
+		b, errRead := io.ReadAll(io.LimitReader(part, uploadFormMaxFieldBytes+1))
+		part.Close()
+		if errRead != nil {
+			return nil, nil, errRead
+		}
+		if len(b) > uploadFormMaxFieldBytes {
+			return nil, nil, fmt.Errorf("Form field %s is too long.", part.FormName())
+		}
+		fields.Add(part.FormName(), string(b))
+	}
+	return nil, nil, fmt.Errorf("Too many form fields.")
+}
+
 func (p *Page) handlePost(w http.ResponseWriter, r *http.Request) (err error) {
-	r.ParseMultipartForm(32 << 20)
-	file, handler, errForm := r.FormFile("file")
-	if errForm != nil {
-		err = errForm
-		log.Error(err)
+	throttleUpload(r)
+	fields, file, err := readUploadForm(r)
+	if err != nil {
+		log.Debug(err)
 		return err
 	}
-	defer file.Close()
-	fname, _ := filepath.Abs(handler.Filename)
+	// the file is not closed, which would read the rest of a refused upload
+	fname, _ := filepath.Abs(file.FileName())
 	_, fname = filepath.Split(fname)
 
-	log.Debugf("%+v", r.Form)
-	chunkNum, _ := strconv.Atoi(r.FormValue("dzchunkindex"))
+	log.Debugf("%+v", fields)
+	chunkNum, _ := strconv.Atoi(fields.Get("dzchunkindex"))
 	chunkNum++
-	totalChunks, _ := strconv.Atoi(r.FormValue("dztotalchunkcount"))
-	chunkSize, _ := strconv.Atoi(r.FormValue("dzchunksize"))
-	if int64(totalChunks)*int64(chunkSize) > c.MaxBytesPerFile {
-		err = fmt.Errorf("Upload exceeds max file size: %s.", c.MaxBytesPerFileHuman)
+	totalChunks, _ := strconv.Atoi(fields.Get("dztotalchunkcount"))
+	chunkSize, _ := strconv.Atoi(fields.Get("dzchunksize"))
+	if int64(totalChunks)*int64(chunkSize) > p.Config.MaxBytesPerFile {
+		err = fmt.Errorf("Upload exceeds max file size: %s.", p.Config.MaxBytesPerFileHuman)
 		jsonResponse(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
 		return nil
 	}
-	uuid := r.FormValue("dzuuid")
+	uuid := fields.Get("dzuuid")
+	if uuid == "" || chunkNum > totalChunks {
+		return fmt.Errorf("Not a chunk of an upload.")
+	}
 	log.Debugf("working on chunk %d/%d for %s", chunkNum, totalChunks, uuid)
+	// limit the uploads, not the chunks, and before the data is read
+	if ok, retryAfter := startUploadSession(uuid, rateLimitKey(r), p.Config); !ok {
+		tooManyRequests(w, r, retryAfter)
+		return nil
+	}
 
-	f, err := os.CreateTemp(c.ContentDirectory, "sharetemp")
+	f, err := os.CreateTemp(p.Config.ContentDirectory, "sharetemp")
 	if err != nil {
 		log.Error(err)
 		return
 	}
-	// remove temp file when finished
-	_, err = CopyMax(f, file, c.MaxBytesPerFile)
+	// a chunk is at most the chunk size
+	maxBytes := p.Config.MaxBytesPerFile
+	if chunkSize > 0 && int64(chunkSize) < maxBytes {
+		maxBytes = int64(chunkSize) + 1
+	}
+	_, err = CopyMax(f, file, maxBytes)
+	f.Close()
 	if err != nil {
 		log.Error(err)
+		os.Remove(f.Name())
+		return
 	}
-	f.Close()
 
 	// check if need to cat
 	uploadsLock.Lock()
 	if _, ok := uploadsInProgress[uuid]; !ok {
 		uploadsInProgress[uuid] = 0
 	}
-	uploadsInProgress[uuid]++
+	if _, ok := uploadsStarted[uuid]; !ok {
+		uploadsStarted[uuid] = time.Now()
+	}
+	if previous, ok := uploadsFileNames[fmt.Sprintf("%s%d", uuid, chunkNum)]; ok {
+		// the chunk is being uploaded again, e.g. when resuming after a restart
+		os.Remove(previous)
+	} else {
+		uploadsInProgress[uuid]++
+	}
 	uploadsFileNames[fmt.Sprintf("%s%d", uuid, chunkNum)] = f.Name()
 	if uploadsInProgress[uuid] == totalChunks {
 		err = func() (err error) {
@@ -378,7 +666,7 @@ func (p *Page) handlePost(w http.ResponseWriter, r *http.Request) (err error) {
 			log.Debugf("%+v", uploadsFileNames)
 			delete(uploadsInProgress, uuid)
 
-			fFinal, _ := os.CreateTemp(c.ContentDirectory, "sharetemp")
+			fFinal, _ := os.CreateTemp(p.Config.ContentDirectory, "sharetemp")
 			fFinalgz := gzip.NewWriter(fFinal)
 			originalSize := int64(0)
 			for i := 1; i <= totalChunks; i++ {
@@ -402,7 +690,17 @@ func (p *Page) handlePost(w http.ResponseWriter, r *http.Request) (err error) {
 			fFinalgz.Close()
 			fFinal.Close()
 			log.Debugf("final written to: %s", fFinal.Name())
-			fname, err = copyToContentDirectory(fname, fFinal.Name(), originalSize)
+			fname, err = copyToContentDirectory(fname, fFinal.Name(), originalSize, uploadOptions{
+				Uploader:      clientIP(r),
+				ContentType:   file.Header.Get("Content-Type"),
+				StripMetadata: stripRequested(r) || (fields.Has("strip") && parseStrip(fields.Get("strip"))),
+			})
+			if err == nil {
+				observeUpload(uploadMethodChunked, originalSize, uploadsStarted[uuid])
+				auditUpload(r, fname)
+			}
+			delete(uploadsStarted, uuid)
+			delete(uploadsClients, uuid)
 
 			log.Debugf("setting uploadsHash: %s", fname)
 			uploadsHashLock.Lock()
@@ -435,6 +733,13 @@ func (p *Page) handlePost(w http.ResponseWriter, r *http.Request) (err error) {
 		if time.Since(startTime).Seconds() > 60*60 {
 			break
 		}
+		if isShuttingDown() {
+			// the chunks received so far are saved, so the client can
+			// resume the upload after the restart
+			w.Header().Set("Retry-After", "10")
+			jsonResponse(w, http.StatusServiceUnavailable, map[string]string{"message": "Server is restarting, please retry the upload."})
+			return nil
+		}
 	}
 
 	// TODO: cleanup if last one, delete uuid from uploadshash
@@ -444,137 +749,153 @@ func (p *Page) handlePost(w http.ResponseWriter, r *http.Request) (err error) {
 }
 
 func (p *Page) handleGetData(w http.ResponseWriter, r *http.Request, decompress bool) (err error) {
+	// the compressed and decompressed data are different representations
+	etag := `"` + p.Hash + `"`
+	if !decompress {
+		etag = `"` + p.Hash + `-gz"`
+	}
+	p.setUploadCacheControl(w)
+	p.setUserContentHeaders(w)
+	if checkNotModified(w, r, etag, p.Modified) {
+		return
+	}
+
 	f, err := os.Open(p.NameOnDisk)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	defer f.Close()
+	if r.Method == http.MethodHead {
+		// the headers are all that is sent, so the data is not read
+		size := p.Size
+		if !decompress {
+			w.Header().Set("Content-Encoding", "gzip")
+			if info, errStat := f.Stat(); errStat == nil {
+				size = info.Size()
+			}
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		return
+	}
+	var n int64
+	out := newThrottledWriter(r.Context(), w, downloadBandwidth(r, p.Config))
 	if decompress {
 		gzf, _ := gzip.NewReader(f)
 		defer gzf.Close()
-		io.Copy(w, gzf)
+		n, _ = io.Copy(out, gzf)
 	} else {
 		w.Header().Set("Content-Encoding", "gzip")
-		w.Header().Set("Content-Type", p.ContentType)
-		io.Copy(w, f)
+		n, _ = io.Copy(out, f)
+	}
+	observeDownload(r, n)
+	if r.Method == http.MethodGet {
+		auditRequest(r, auditEventDownload, p)
 	}
 	return
 }
 
 func (p *Page) handleShowDataInBrowser(w http.ResponseWriter, r *http.Request) (err error) {
 	log.Debugf("%+v", p)
-	if p.IsASCII && p.Size < 10000000 {
+	if p.Scanning() || p.ScanFailed() {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
 		log.Debugf("showing page %s", p.ID)
-		b, _ := os.ReadFile(p.NameOnDisk)
-		gr, errGzip := gzip.NewReader(bytes.NewBuffer(b))
-		if errGzip != nil {
-			err = errGzip
-			log.Error(err)
-			return
-		}
-		defer gr.Close()
-		var textBytes []byte
-		textBytes, err = io.ReadAll(gr)
+		err = p.loadPreview()
 		if err != nil {
 			log.Error(err)
 			return
 		}
-
-		p.Text = string(textBytes)
 	}
 	indexTemplate.Execute(w, p)
 	return
 }
 
+// handleGetInfo returns the information about the data as JSON
+func (p *Page) handleGetInfo(w http.ResponseWriter, r *http.Request) (err error) {
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"id":                     p.ID,
+		"name":                   p.Name,
+		"size":                   p.Size,
+		"size_human":             p.SizeHuman,
+		"content_type":           p.ContentType,
+		"modified":               p.Modified,
+		"url":                    p.Config.PublicURL + "/" + p.ID + "/" + p.Name,
+		"raw_url":                p.AbsoluteRawURL(),
+		"time_to_deletion":       p.TimeToDeletion.Seconds(),
+		"time_to_deletion_human": p.TimeToDeletionHuman,
+		"scan_status":            p.ScanStatus,
+		"sanitized":              p.Sanitized,
+	})
+	return
+}
+
 func (p *Page) handleGetHome(w http.ResponseWriter, r *http.Request) (err error) {
 	// https://astaxie.gitbooks.io/build-web-application-with-golang/en/04.5.html
 	return indexTemplate.Execute(w, p)
 }
 
-// handle is the function for the main routing logic of share.
-func handle(w http.ResponseWriter, r *http.Request) (err error) {
-	// first get ID and filename if it is availble
-	p := NewPage()
-	if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/delete/") {
-		// GET /delete/ID will delete the ID
-		urlPathSplit := strings.Split(r.URL.Path, "/")
-		id := urlPathSplit[len(urlPathSplit)-1]
-		_, errStat := os.Stat(path.Join(c.ContentDirectory, id))
-		if errStat != nil {
-			err = fmt.Errorf("Data with id '%s' does not exist.", id)
-			return
-		}
-		os.RemoveAll(path.Join(c.ContentDirectory, id))
-		p := NewPage()
-		p.Error = fmt.Sprintf("Removed %s.", id)
-		return p.handleGetHome(w, r)
-	} else if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/exists/") {
-		urlPathSplit := strings.Split(r.URL.Path, "/")
-		if len(urlPathSplit) < 3 {
-			jsonResponse(w, http.StatusOK, map[string]string{"exists": "yes", "id": "", "name": ""})
-		}
-		id := filepath.Clean(urlPathSplit[len(urlPathSplit)-2])
-		name := filepath.Clean(urlPathSplit[len(urlPathSplit)-1])
-		_, errStat := os.Stat(path.Join(c.ContentDirectory, id, name))
-		if errStat != nil {
-			jsonResponse(w, http.StatusOK, map[string]string{"exists": "no", "id": id, "name": name})
-		} else {
-			jsonResponse(w, http.StatusOK, map[string]string{"exists": "yes", "id": id, "name": name})
-		}
-		return nil
-	} else if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/static/") {
-		// GET /static/<file> will return the <file> if it exists
-		p.NameOnDisk = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(r.URL.Path[1:])), "/") + ".gz"
-		var b []byte
-		b, err = content.ReadFile(p.NameOnDisk)
-		if err != nil {
-			log.Error(err)
-			return
-		}
-		p.ContentType, _, err = GetFileContentTypeReader(p.NameOnDisk, bytes.NewBuffer(b))
-		if err != nil {
-			log.Error(err)
-			return
-		}
-		log.Debugf("serving static file: %s (%s)", p.NameOnDisk, p.ContentType)
-		w.Header().Set("Content-Encoding", "gzip")
-		w.Header().Set("Content-Type", p.ContentType)
-		_, err = w.Write(b)
-		return
-	} else if r.Method == "GET" && len(r.URL.Path) > 1 {
-		// GET /<id> or /<id>/<filename> are the only other routes
-		urlPath := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(r.URL.Path[1:])), "1/")
-		log.Debugf("urlPath: %s", urlPath)
-		urlPathSplit := strings.Split(urlPath, "/")
-		id := urlPathSplit[0]
-		var fname string
-		if len(urlPathSplit) > 1 {
-			fname = urlPathSplit[1]
-		}
-		_, errStat := os.Stat(path.Join(c.ContentDirectory, p.ID))
-		if errStat != nil {
-			err = fmt.Errorf("Data with id '%s' does not exist.", id)
-			return
-		}
-		p, err = loadPageInfo(id)
-		if err != nil {
-			err = fmt.Errorf("Data with id '%s' does not exist.", id)
-			return
-		}
+// notFoundError is returned for data or paths that do not exist
+type notFoundError struct {
+	message string
+}
 
-		if fname == "" || fname != p.Name {
-			http.Redirect(w, r, fmt.Sprintf("/%s/%s", p.ID, p.Name), 302)
-			return
-		}
-		_, errStat = os.Stat(path.Join(c.ContentDirectory, p.ID, p.Name))
-		if errStat != nil {
-			err = fmt.Errorf("Data with id '%s' does not exist.", id)
-			return
-		}
-	}
+func (e notFoundError) Error() string {
+	return e.message
+}
 
+// errNotFound is returned for paths that do not exist
+var errNotFound = notFoundError{"Not found."}
+
+// errDoesNotExist is returned for IDs that do not exist
+func errDoesNotExist(id string) error {
+	return notFoundError{fmt.Sprintf("Data with id '%s' does not exist.", id)}
+}
+
+// newRouter returns the router with all the routes of share.
+func newRouter() *router {
+	rt := new(router)
+	rt.Use(logRequests, instrumentRequests, allowCORS, separateUserContent)
+	rt.Handle("home", "GET", "/", handleHome)
+	rt.Handle("metrics", "GET", "/metrics", handleMetrics)
+	rt.Handle("healthz", "GET", "/healthz", handleHealthz)
+	rt.Handle("readyz", "GET", "/readyz", handleReadyz)
+	rt.Handle("admin", "GET", "/admin", handleAdmin, requireAdmin)
+	rt.Handle("admin-status", "GET", "/admin/status", handleAdminStatus, requireAdmin)
+	rt.Handle("admin-delete", "POST", "/admin/{id}/delete", handleAdminDelete, requireAdmin)
+	rt.Handle("admin-extend", "POST", "/admin/{id}/extend", handleAdminExtend, requireAdmin)
+	rt.Handle("admin-block", "POST", "/admin/{id}/block", handleAdminBlock, requireAdmin)
+	rt.Handle("admin-unblock", "POST", "/admin/blocked/{hash}/unblock", handleAdminUnblock, requireAdmin)
+	rt.Handle("admin-report", "POST", "/admin/reports/{report}/{action}", handleAdminReport, requireAdmin)
+	rt.Handle("report", "POST", "/{id}/report", handleReport, limitNotFound, limitRate(reportLimiters, func(cfg Config) rateSpec { return cfg.rateReports }))
+	rt.Handle("upload", "POST", "/", handleUpload)
+	rt.Handle("paste", "POST", "/paste", handlePaste, limitConcurrentUploads, limitRate(uploadLimiters, func(cfg Config) rateSpec { return cfg.rateUploads }))
+	rt.Handle("static", "GET", "/static/{file...}", handleStatic)
+	rt.Handle("delete", "GET", "/delete/{id}", handleDelete, limitNotFound)
+	rt.Handle("exists", "GET", "/exists/{id}/{name}", handleExists, limitRate(existsLimiters, func(cfg Config) rateSpec { return cfg.rateExists }))
+	rt.Handle("raw", "GET", "/1/{id}/{name}", handleRaw, limitNotFound, limitDownloads)
+	rt.Handle("stream", "GET", "/stream/{id}/{name}", handleStream, limitNotFound, limitDownloads)
+	rt.Handle("lines", "GET", "/lines/{id}/{name}", handleLines, limitNotFound)
+	rt.Handle("oembed", "GET", "/oembed", handleOEmbed, limitNotFound)
+	rt.Handle("thumb", "GET", "/{id}/thumb", handleThumb, limitNotFound)
+	rt.Handle("permalink", "GET", "/{id}", handleView, limitNotFound, limitDownloads)
+	rt.Handle("view", "GET", "/{id}/{name}", handleView, limitNotFound, limitDownloads)
+	rt.Handle("put", "PUT", "/{name...}", handleUploadPut, limitConcurrentUploads, limitRate(uploadLimiters, func(cfg Config) rateSpec { return cfg.rateUploads }))
+	return rt
+}
+
+// newRequestPage returns a new page with the information about the request.
+func newRequestPage(r *http.Request) (p *Page) {
+	p = NewPage()
+	p.setRequest(r)
+	return
+}
+
+// setRequest sets the page specific information for the request.
+func (p *Page) setRequest(r *http.Request) {
 	// set the config
-	p.Config = c
+	p.Config = getConfig()
+	p.Config.PublicURL = publicURL(r)
 
 	// generate key
 	h := md5.New()
@@ -583,52 +904,223 @@ func handle(w http.ResponseWriter, r *http.Request) (err error) {
 
 	// get user agent information
 	p.UserAgent = uasurfer.Parse(r.Header.Get("User-Agent"))
+}
 
-	// TODO: allow authorizatoin
-	// // get authorization informaiton
-	// auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
-	// if len(auth) > 0 && auth[0] == "Basic" {
-	// 	log.Info(auth)
-	// 	payload, _ := base64.StdEncoding.DecodeString(auth[1])
-	// 	pair := strings.SplitN(string(payload), ":", 2)
-	// 	log.Debug(pair)
-	// }
-
-	if r.Method == "PUT" {
-		// PUT file
-		// this is called from curl/wget upload
-		return p.handlePut(w, r)
-	} else if r.Method == "POST" {
-		// POST file
-		// this is called from browser upload
-		return p.handlePost(w, r)
-	} else if r.Method == "GET" {
-		if strings.HasPrefix(r.URL.Path, "/1/") {
-			// GET /1/ID/<filename> will show the raw data
-			return p.handleGetData(w, r, false)
+// loadRequestPage loads the page for the ID in the route and checks that
+// its data exists.
+func loadRequestPage(r *http.Request) (p *Page, err error) {
+	return loadPageForRequest(r, routeParam(r, "id"))
+}
+
+// loadPageForRequest loads the page for an ID and checks that its data
+// exists.
+func loadPageForRequest(r *http.Request, id string) (p *Page, err error) {
+	p, err = loadPageInfo(id)
+	if err != nil {
+		return nil, errDoesNotExist(id)
+	}
+	if _, errStat := os.Stat(p.NameOnDisk); errStat != nil {
+		return nil, errDoesNotExist(id)
+	}
+	p.setRequest(r)
+	return
+}
+
+// refuseUploadsWhenShuttingDown stops accepting uploads while draining the
+// ones in progress
+func refuseUploadsWhenShuttingDown(w http.ResponseWriter) bool {
+	if !isShuttingDown() {
+		return false
+	}
+	w.Header().Set("Retry-After", "10")
+	jsonResponse(w, http.StatusServiceUnavailable, map[string]string{"message": "Server is restarting, please retry the upload."})
+	return true
+}
+
+// handleHome handles GET / and shows the home page
+func handleHome(w http.ResponseWriter, r *http.Request) error {
+	return newRequestPage(r).handleGetHome(w, r)
+}
+
+// handleUpload handles POST / which is called from browser upload
+func handleUpload(w http.ResponseWriter, r *http.Request) error {
+	if refuseUploadsWhenShuttingDown(w) {
+		return nil
+	}
+	return newRequestPage(r).handlePost(w, r)
+}
+
+// handleUploadPut handles PUT /<filename> which is called from curl/wget
+// upload
+func handleUploadPut(w http.ResponseWriter, r *http.Request) error {
+	if refuseUploadsWhenShuttingDown(w) {
+		return nil
+	}
+	return newRequestPage(r).handlePut(w, r)
+}
+
+// handleStatic handles GET /static/<file> and returns the <file> if it exists
+func handleStatic(w http.ResponseWriter, r *http.Request) (err error) {
+	p := newRequestPage(r)
+	name := strings.TrimPrefix(path.Clean("/"+routeParam(r, "file")), "/")
+	p.NameOnDisk = path.Join("static", name) + ".gz"
+	var b []byte
+	b, err = content.ReadFile(p.NameOnDisk)
+	if err != nil {
+		log.Error(err)
+		return errNotFound
+	}
+	setStaticCacheControl(w, r, name)
+	if checkNotModified(w, r, `"`+staticHashes[name]+`"`, time.Time{}) {
+		return
+	}
+	p.ContentType, _, err = GetFileContentTypeReader(name, bytes.NewBuffer(b))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	log.Debugf("serving static file: %s (%s)", p.NameOnDisk, p.ContentType)
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", p.ContentType)
+	_, err = w.Write(b)
+	return
+}
+
+// handleDelete handles GET /delete/<id> and deletes the data
+func handleDelete(w http.ResponseWriter, r *http.Request) (err error) {
+	id := filepath.Base(routeParam(r, "id"))
+	err = deletePage(r, id, deletionUser)
+	if err != nil {
+		return
+	}
+	p := newRequestPage(r)
+	p.Error = fmt.Sprintf("Removed %s.", id)
+	return p.handleGetHome(w, r)
+}
+
+// deletePage deletes the data with the ID for a request
+func deletePage(r *http.Request, id string, reason string) (err error) {
+	cfg := getConfig()
+	_, errStat := os.Stat(path.Join(cfg.ContentDirectory, id))
+	if errStat != nil {
+		return errDoesNotExist(id)
+	}
+	deleted, errInfo := loadPageInfo(id)
+	if errInfo != nil {
+		deleted = &Page{ID: id}
+	}
+	err = removeUpload(id)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	pages.Delete(id)
+	observeDeletion(reason)
+	auditRequest(r, auditEventDelete, deleted)
+	return
+}
+
+// removeUpload deletes the directory of an upload and takes its size off
+// the stored bytes
+func removeUpload(id string) (err error) {
+	dir := path.Join(getConfig().ContentDirectory, id)
+	size, _, _ := DirSize(dir)
+	err = os.RemoveAll(dir)
+	if err == nil {
+		metricStoredBytes.Sub(float64(size))
+	}
+	return
+}
+
+// moveUpload moves the directory of an upload out of the data directory
+func moveUpload(id string, dst string) (err error) {
+	src := path.Join(getConfig().ContentDirectory, id)
+	size, _, _ := DirSize(src)
+	err = os.Rename(src, dst)
+	if err != nil {
+		// e.g. the destination is on another file system
+		err = copyDir(src, dst)
+		if err != nil {
+			return
 		}
-		if p.Name == "" || p.ID == "" {
-			// GET /
-			// show home page
-			return p.handleGetHome(w, r)
+		return removeUpload(id)
+	}
+	metricStoredBytes.Sub(float64(size))
+	return
+}
+
+// handleExists handles GET /exists/<id>/<filename> and returns whether the
+// data exists
+func handleExists(w http.ResponseWriter, r *http.Request) error {
+	cfg := getConfig()
+	id := filepath.Base(routeParam(r, "id"))
+	name := filepath.Base(routeParam(r, "name"))
+	_, errStat := os.Stat(path.Join(cfg.ContentDirectory, id, name))
+	if errStat != nil {
+		jsonResponse(w, http.StatusOK, map[string]string{"exists": "no", "id": id, "name": name})
+	} else {
+		thumb := ""
+		if p, ok := pages.Get(id); ok && p.HasThumbnail() {
+			thumb = cfg.BasePath + p.ThumbnailLink()
 		}
-		// show data
-		if p.UserAgent.Browser.Name == uasurfer.BrowserUnknown {
-			// GET raw data and also decomppress it
-			return p.handleGetData(w, r, true)
-		} else {
-			// GET /<id>/<filename> and show in browser
-			return p.handleShowDataInBrowser(w, r)
+		jsonResponse(w, http.StatusOK, map[string]string{"exists": "yes", "id": id, "name": name, "thumb": thumb})
+	}
+	return nil
+}
+
+// handleRaw handles GET /1/<id>/<filename> and returns the raw data
+func handleRaw(w http.ResponseWriter, r *http.Request) error {
+	p, err := loadRequestPage(r)
+	if err != nil {
+		return err
+	}
+	if p.refuseUnscanned(w, r) {
+		return nil
+	}
+	if wantsVariant(r) {
+		return p.handleVariant(w, r)
+	}
+	return p.handleGetData(w, r, false)
+}
+
+// handleView handles GET /<id> and GET /<id>/<filename> and shows the data
+// in the browser, or returns the decompressed data or the information as
+// JSON depending on what the client asks for
+func handleView(w http.ResponseWriter, r *http.Request) error {
+	p, err := loadRequestPage(r)
+	if err != nil {
+		return err
+	}
+	if routeParam(r, "name") != p.Name {
+		http.Redirect(w, r, fmt.Sprintf("%s/%s/%s", p.Config.BasePath, p.ID, p.Name), 302)
+		return nil
+	}
+	return p.handleView(w, r)
+}
+
+// handleView shows the data in the browser, or returns the decompressed
+// data or the information as JSON depending on what the client asks for
+func (p *Page) handleView(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Add("Vary", "Accept")
+	switch negotiateClient(r) {
+	case clientJSON:
+		return p.handleGetInfo(w, r)
+	case clientRaw:
+		if p.refuseUnscanned(w, r) {
+			return nil
 		}
+		// GET raw data and also decomppress it
+		return p.handleGetData(w, r, true)
 	}
-	return
+	return p.handleShowDataInBrowser(w, r)
 }
 
 // loadPageInfo loads the meta information from the supplied ID
 // and calculates information from it and returns the information as a Page type.
 func loadPageInfo(id string) (p *Page, err error) {
+	cfg := getConfig()
 	p = NewPage()
-	f, err := os.Open(path.Join(c.ContentDirectory, id, id+".json.gz"))
+	f, err := os.Open(path.Join(cfg.ContentDirectory, id, id+".json.gz"))
 	if err != nil {
 		return
 	}
@@ -645,17 +1137,29 @@ func loadPageInfo(id string) (p *Page, err error) {
 		return nil, err
 	}
 
-	p.NameOnDisk = path.Join(c.ContentDirectory, p.ID, p.Name)
-	p.TimeToDeletion = (time.Duration(c.MinutesPerGigabyte) * time.Minute) * time.Duration(1000000000/p.Size)
-	p.TimeToDeletionHuman = durafmt.Parse(p.TimeToDeletion).String()
+	p.NameOnDisk = path.Join(cfg.ContentDirectory, p.ID, p.Name)
+	p.TimeToDeletion = timeToDeletion(cfg, p.Size) + p.Extension
+	p.TimeToDeletionHuman = durafmt.Parse(p.TimeToDeletion.Round(time.Minute)).String()
 	p.ModifiedHuman = HumanizeTime(p.Modified)
 	return
 }
 
+// uploadOptions are what the client of an upload says about it
+type uploadOptions struct {
+	// Uploader is the IP of the client
+	Uploader string
+	// ContentType is the content type that the client declared
+	ContentType string
+	// StripMetadata is whether the client asked for the metadata of an
+	// image to be stripped
+	StripMetadata bool
+}
+
 // writeAllBytes takes a reader and writes it to the content directory.
 // It throws an error if the number of bytes written exceeds what is set.
-func writeAllBytes(fname string, src io.Reader) (fnameFull string, err error) {
-	f, err := os.CreateTemp(c.ContentDirectory, "sharetemp")
+func writeAllBytes(fname string, src io.Reader, opts uploadOptions) (fnameFull string, err error) {
+	cfg := getConfig()
+	f, err := os.CreateTemp(cfg.ContentDirectory, "sharetemp")
 	if err != nil {
 		log.Error(err)
 		return
@@ -665,7 +1169,7 @@ func writeAllBytes(fname string, src io.Reader) (fnameFull string, err error) {
 	w := gzip.NewWriter(f)
 
 	// try to write the bytes
-	n, err := CopyMax(w, src, c.MaxBytesPerFile)
+	n, err := CopyMax(w, src, cfg.MaxBytesPerFile)
 	w.Flush()
 	w.Close()
 	f.Close()
@@ -678,35 +1182,60 @@ func writeAllBytes(fname string, src io.Reader) (fnameFull string, err error) {
 	} else {
 		log.Debugf("wrote %d bytes to %s", n, f.Name())
 	}
-	return copyToContentDirectory(fname, f.Name(), n)
+	return copyToContentDirectory(fname, f.Name(), n, opts)
 }
 
 // copyToContentDirectory will move the temp file to the content directory and calculate
 // the hash for generating the ID. It will also save the meta information in the content
 // directory (the .json.gz files).
-func copyToContentDirectory(fname string, tempFname string, originalSize int64) (fnameFull string, err error) {
+func copyToContentDirectory(fname string, tempFname string, originalSize int64, opts uploadOptions) (fnameFull string, err error) {
+	cfg := getConfig()
 	defer func() {
 		os.Remove(tempFname)
 		go TrimContent()
 	}()
 
 	hash, _ := Filemd5Sum(tempFname)
+	if blocklist.IsBlocked(hash) {
+		log.Infof("refusing blocked upload %s from %s", hash, opts.Uploader)
+		err = errBlocked
+		return
+	}
+	sanitized := false
+	if cfg.StripMetadata || opts.StripMetadata {
+		var size int64
+		sanitized, size, err = stripUploadMetadata(tempFname)
+		if err != nil {
+			// the uploader was promised that the metadata is gone
+			log.Warnf("could not strip metadata of %s: %s", fname, err.Error())
+			err = fmt.Errorf("Could not remove the metadata of %s, it was not uploaded.", fname)
+			return
+		} else if sanitized {
+			originalSize = size
+			hash, _ = Filemd5Sum(tempFname)
+			if blocklist.IsBlocked(hash) {
+				log.Infof("refusing blocked upload %s from %s", hash, opts.Uploader)
+				err = errBlocked
+				return
+			}
+		}
+	}
 	// id := strings.ToLower(base32.StdEncoding.EncodeToString([]byte(hash)))[:8]
 	id := RandomName(hash)
 	// id := WordHash(hash)
-	if _, err = os.Stat(path.Join(c.ContentDirectory, id)); !os.IsNotExist(err) {
-		err = os.RemoveAll(path.Join(c.ContentDirectory, id))
+	if _, err = os.Stat(path.Join(cfg.ContentDirectory, id)); !os.IsNotExist(err) {
+		err = removeUpload(id)
 		if err != nil {
 			log.Error(err)
 			return
 		}
 	}
-	err = os.MkdirAll(path.Join(c.ContentDirectory, id), os.ModePerm)
+	err = os.MkdirAll(path.Join(cfg.ContentDirectory, id), os.ModePerm)
 	if err != nil {
 		log.Error(err)
 		return
 	}
-	err = os.Rename(tempFname, path.Join(c.ContentDirectory, id, fname))
+	err = os.Rename(tempFname, path.Join(cfg.ContentDirectory, id, fname))
 	if err != nil {
 		log.Error(err)
 		return
@@ -721,43 +1250,69 @@ func copyToContentDirectory(fname string, tempFname string, originalSize int64)
 	p.Name = fname
 	p.Size = originalSize
 	p.SizeHuman = HumanizeBytes(originalSize)
+	p.Uploader = opts.Uploader
+	p.Sanitized = sanitized
 	p.Modified = time.Now()
 	p.ModifiedHuman = HumanizeTime(p.Modified)
 	p.Link = fmt.Sprintf("/1/%s/%s", p.ID, p.Name)
-	var isASCIIIData bool
-	p.ContentType, isASCIIIData, err = GetFileContentType(path.Join(c.ContentDirectory, p.ID, p.Name))
+	ct, err := resolveUploadContentType(cfg, path.Join(cfg.ContentDirectory, p.ID, p.Name), opts.ContentType)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	p.ContentType, p.DetectedContentType, p.DeclaredContentType = ct.ContentType, ct.Detected, ct.Declared
 	p.IsImage = strings.Contains(p.ContentType, "image/")
 	p.IsText = strings.Contains(p.ContentType, "text/")
 	p.IsAudio = strings.Contains(p.ContentType, "audio/")
 	p.IsVideo = strings.Contains(p.ContentType, "video/")
-	p.IsASCII = isASCIIIData
+	p.IsASCII = ct.IsText
+	if newScanner(cfg) != nil {
+		p.ScanStatus = scanPending
+	}
+
+	err = savePageInfo(p)
+	if err != nil {
+		return
+	}
+	observeStored(p.ID)
+	p.NameOnDisk = path.Join(cfg.ContentDirectory, p.ID, p.Name)
+	p.TimeToDeletion = timeToDeletion(cfg, p.Size) + p.Extension
+	p.TimeToDeletionHuman = durafmt.Parse(p.TimeToDeletion.Round(time.Minute)).String()
+	pages.Put(p)
+	if p.Scanning() {
+		startScan(p)
+	} else {
+		startThumbnail(p)
+	}
+	return
+}
 
-	// write gzipped JSON
-	fWrite, err := os.Create(path.Join(c.ContentDirectory, id, id+".json.gz"))
+// savePageInfo writes the meta information of the data as gzipped JSON
+// next to the data
+func savePageInfo(p *Page) (err error) {
+	return writePageInfo(path.Join(getConfig().ContentDirectory, p.ID, p.ID+".json.gz"), p)
+}
+
+// writePageInfo writes the information of an upload to a file
+func writePageInfo(fname string, p *Page) (err error) {
+	fWrite, err := os.Create(fname)
 	if err != nil {
 		log.Error(err)
 		return
 	}
 	defer fWrite.Close()
 	wf := gzip.NewWriter(fWrite)
-	defer wf.Close()
 	enc := json.NewEncoder(wf)
+	enc.SetIndent("", " ")
+	err = enc.Encode(p)
 	if err != nil {
 		log.Error(err)
 		return
 	}
-	enc.SetIndent("", " ")
-	err = enc.Encode(p)
+	err = wf.Close()
 	if err != nil {
 		log.Error(err)
-		return
 	}
-	err = wf.Flush()
-
 	return
 }
 
@@ -810,68 +1365,11 @@ func Filemd5Sum(pathToFile string) (result string, err error) {
 	return
 }
 
-// GetFileContentType returns the MIME content-type of a file
-func GetFileContentType(fname string) (contentType string, isaciii bool, err error) {
-	// Open a file descriptor
-	file, err := os.Open(fname)
-	if err != nil {
-		return
-	}
-	defer file.Close()
-
-	return GetFileContentTypeReader(fname, file)
-}
-
 // GetFileContentTypeReader returns the MIME content-type from the bytes and
-// a file name.
-func GetFileContentTypeReader(fname string, file io.Reader) (contentType string, isaciii bool, err error) {
-	gz, err := gzip.NewReader(file)
-	if err != nil {
-		return
-	}
-	defer gz.Close()
-
-	// We only have to pass the file header = first 261 bytes
-	head := make([]byte, 261)
-	gz.Read(head)
-
-	kind, err := filetype.Match(head)
-	if err != nil {
-		return
-	}
-	if kind == filetype.Unknown {
-		contentType = strings.Split(http.DetectContentType(head), ";")[0]
-		if contentType == "application/octet-stream" {
-			if isASCII(string(head)) {
-				contentType = "text/plain"
-			}
-		}
-	} else {
-		contentType = kind.MIME.Value
-	}
-
-	// if we have a text file, then use the filename to force what the
-	// content type should be
-	if contentType == "text/plain" {
-		if strings.Contains(fname, ".js") {
-			contentType = "application/javascript"
-		} else if strings.Contains(fname, ".css") {
-			contentType = "text/css"
-		}
-	}
-	isaciii = isASCII(string(head))
-	return
-}
-
-// isASCII returns whether a set of string-converted bytes
-// are actually readable text.
-func isASCII(s string) bool {
-	for i := 0; i < len(s); i++ {
-		if s[i] > unicode.MaxASCII {
-			return false
-		}
-	}
-	return true
+// a file name, and whether the data is text. Text types get their charset.
+func GetFileContentTypeReader(fname string, file io.Reader) (contentType string, isText bool, err error) {
+	ct, err := resolveContentType(getConfig(), fname, "", file)
+	return ct.ContentType, ct.IsText, err
 }
 
 // RandString prints a random string
@@ -1033,7 +1531,7 @@ func CopyMax(dst io.Writer, src io.Reader, maxBytes int64) (n int64, err error)
 	}
 
 	if n >= maxBytes {
-		err = fmt.Errorf("Upload exceeds maximum size (%s).", c.MaxBytesPerFileHuman)
+		err = fmt.Errorf("Upload exceeds maximum size (%s).", HumanizeBytes(maxBytes))
 	} else {
 		err = nil
 	}
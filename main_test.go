@@ -2,19 +2,60 @@ package main
 
 import (
 	"bytes"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestWordHash(t *testing.T) {
-	assert.Equal(t, "intensional-catfish", WordHash("test"))
+// TestMain sets up a configuration like the default flags, with the data
+// in a temporary directory
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "sharetest")
+	if err != nil {
+		panic(err)
+	}
+	setConfig(testConfig(dir))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testConfig returns a configuration like the default flags
+func testConfig(dir string) Config {
+	cfg := Config{
+		ContentDirectory:   dir,
+		Port:               "8222",
+		MaxBytesPerFile:    100000000,
+		MaxBytesTotal:      10000000000,
+		MinutesPerGigabyte: 30,
+		DeclaredTypes:      defaultDeclaredTypes,
+		Thumbnails:         true,
+	}
+	finalizeConfig(&cfg)
+	return cfg
+}
+
+// useTestConfig sets a configuration with its own data directory for the
+// duration of a test
+func useTestConfig(t *testing.T) Config {
+	old := getConfig()
+	t.Cleanup(func() { setConfig(old) })
+	cfg := testConfig(t.TempDir())
+	setConfig(cfg)
+	return cfg
+}
+
+func TestRandomName(t *testing.T) {
+	assert.Equal(t, RandomName("test"), RandomName("test"))
+	assert.Len(t, RandomName("test"), 3)
 }
 
 func TestAsset(t *testing.T) {
-	b, err := Asset("static/style.css.gz")
+	b, err := content.ReadFile("static/style.css.gz")
 	assert.Nil(t, err)
-	contentType, err := GetFileContentTypeReader("statc/style.css.gz", bytes.NewBuffer(b))
+	contentType, isText, err := GetFileContentTypeReader("static/style.css", bytes.NewBuffer(b))
 	assert.Nil(t, err)
-	assert.Equal(t, "text/css", contentType)
+	assert.True(t, isText)
+	assert.Equal(t, "text/css; charset=utf-8", contentType)
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/schollz/logger"
+)
+
+// upload methods used as metric labels
+const (
+	uploadMethodPut     = "put"
+	uploadMethodChunked = "chunked"
+	uploadMethodPaste   = "paste"
+)
+
+// deletion reasons used as metric labels
+const (
+	deletionExpired     = "expired"
+	deletionTrimmed     = "trimmed"
+	deletionUser        = "user"
+	deletionAdmin       = "admin"
+	deletionBlocked     = "blocked"
+	deletionQuarantined = "quarantined"
+)
+
+var (
+	metricUploads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "share_uploads_total",
+		Help: "Number of finished uploads.",
+	}, []string{"method"})
+	metricUploadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "share_upload_bytes_total",
+		Help: "Number of bytes of finished uploads.",
+	}, []string{"method"})
+	metricUploadSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "share_upload_size_bytes",
+		Help:    "Size of finished uploads.",
+		Buckets: prometheus.ExponentialBuckets(1000, 10, 8),
+	}, []string{"method"})
+	metricUploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "share_upload_duration_seconds",
+		Help:    "Time from the start to the end of an upload.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"method"})
+	metricDownloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "share_downloads_total",
+		Help: "Number of downloads of uploaded data.",
+	}, []string{"route"})
+	metricDownloadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "share_download_bytes_total",
+		Help: "Number of bytes sent for downloads of uploaded data.",
+	}, []string{"route"})
+	metricErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "share_errors_total",
+		Help: "Number of responses with an error status code.",
+	}, []string{"route", "code"})
+	metricDeletions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "share_deletions_total",
+		Help: "Number of deleted uploads.",
+	}, []string{"reason"})
+	metricScans = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "share_scan_duration_seconds",
+		Help:    "Time to scan uploads, by result.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"result"})
+	metricRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "share_rate_limited_total",
+		Help: "Number of requests refused by the rate limits.",
+	}, []string{"route"})
+	metricRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "share_request_duration_seconds",
+		Help:    "Latency of requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "share_active_chunk_sessions",
+		Help: "Number of chunked uploads in progress.",
+	}, func() float64 {
+		uploadsLock.Lock()
+		defer uploadsLock.Unlock()
+		return float64(len(uploadsInProgress))
+	})
+	metricStoredBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "share_stored_bytes",
+		Help: "Number of bytes in the data directory.",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "share_max_stored_bytes",
+		Help: "Maximum number of bytes in the data directory.",
+	}, func() float64 {
+		return float64(getConfig().MaxBytesTotal)
+	})
+)
+
+// metricsHandler serves the metrics from the default registry
+var metricsHandler = promhttp.Handler()
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	N int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.Reader.Read(p)
+	cr.N += int64(n)
+	return
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	io.Writer
+	N int64
+}
+
+func (cw *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.Writer.Write(p)
+	cw.N += int64(n)
+	return
+}
+
+// observeUpload records a finished upload
+func observeUpload(method string, size int64, start time.Time) {
+	metricUploads.WithLabelValues(method).Inc()
+	metricUploadBytes.WithLabelValues(method).Add(float64(size))
+	metricUploadSize.WithLabelValues(method).Observe(float64(size))
+	metricUploadDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// observeStored adds the files of a new upload to the stored bytes. Files
+// made later (thumbnails, variants) are counted by the next cleanup, which
+// measures the whole data directory again.
+func observeStored(id string) {
+	size, _, err := DirSize(path.Join(getConfig().ContentDirectory, id))
+	if err != nil {
+		log.Debugf("could not get size of %s: %s", id, err.Error())
+		return
+	}
+	metricStoredBytes.Add(float64(size))
+}
+
+// observeDownload records a download of uploaded data
+func observeDownload(r *http.Request, n int64) {
+	metricDownloads.WithLabelValues(routeName(r)).Inc()
+	metricDownloadBytes.WithLabelValues(routeName(r)).Add(float64(n))
+}
+
+// observeDeletion records a deleted upload
+func observeDeletion(reason string) {
+	metricDeletions.WithLabelValues(reason).Inc()
+}
+
+// observeScan records a scanned upload
+func observeScan(result string, start time.Time) {
+	metricScans.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// instrumentRequests is the middleware that records the latency of every
+// request and counts the errors by route.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		route := routeName(r)
+		if route == "" {
+			route = "none"
+		}
+		code := strconv.Itoa(rec.Status)
+		metricRequestDuration.WithLabelValues(route, methodLabel(r.Method), code).Observe(time.Since(t).Seconds())
+		if rec.Status >= 400 {
+			metricErrors.WithLabelValues(route, code).Inc()
+		}
+	})
+}
+
+// methodLabel returns the method of a request for the metrics, where the
+// methods that aren't used are "other" so that clients can't add series
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// handleMetrics handles GET /metrics with the metrics for Prometheus
+func handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if !getConfig().Metrics {
+		return errNotFound
+	}
+	metricsHandler.ServeHTTP(w, r)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoredBytes(t *testing.T) {
+	cfg := useTestConfig(t)
+	assert.Nil(t, os.MkdirAll(path.Join(cfg.ContentDirectory, "abc"), 0755))
+	assert.Nil(t, os.WriteFile(path.Join(cfg.ContentDirectory, "abc", "a.txt"), make([]byte, 100), 0644))
+	assert.Nil(t, os.WriteFile(path.Join(cfg.ContentDirectory, "abc", "abc.json.gz"), make([]byte, 20), 0644))
+
+	metricStoredBytes.Set(1000)
+	observeStored("abc")
+	assert.Equal(t, 1120.0, testutil.ToFloat64(metricStoredBytes))
+	assert.Nil(t, removeUpload("abc"))
+	assert.NoDirExists(t, path.Join(cfg.ContentDirectory, "abc"))
+	assert.Equal(t, 1000.0, testutil.ToFloat64(metricStoredBytes))
+}
+
+func TestHandleMetrics(t *testing.T) {
+	cfg := useTestConfig(t)
+	w := httptest.NewRecorder()
+	assert.Equal(t, errNotFound, handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil)))
+
+	cfg.Metrics = true
+	setConfig(cfg)
+	w = httptest.NewRecorder()
+	assert.Nil(t, handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "share_stored_bytes"))
+}
+
+func TestMethodLabel(t *testing.T) {
+	for method, want := range map[string]string{
+		"GET":     "GET",
+		"HEAD":    "HEAD",
+		"POST":    "POST",
+		"PUT":     "PUT",
+		"OPTIONS": "OPTIONS",
+		"DELETE":  "other",
+		"get":     "other",
+		"FOO1234": "other",
+	} {
+		assert.Equal(t, want, methodLabel(method), method)
+	}
+}
+
+func TestInstrumentRequestsMethods(t *testing.T) {
+	handler := instrumentRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	before := testutil.CollectAndCount(metricRequestDuration)
+	for i := 0; i < 10; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("METHOD"+strings.Repeat("X", i), "/", nil))
+	}
+	// all of them are counted as one series
+	assert.LessOrEqual(t, testutil.CollectAndCount(metricRequestDuration), before+1)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/h2non/filetype"
+	log "github.com/schollz/logger"
+)
+
+// defaultDeclaredTypes are the content types that uploaders can declare for
+// their uploads. Types that browsers run (like HTML, SVG and JavaScript)
+// are not in the list, and image/* does not include SVG.
+const defaultDeclaredTypes = "text/plain,text/csv,text/markdown,application/json,application/xml,application/pdf,image/*,audio/*,video/*"
+
+// builtinMimeTypes are the content types of extensions, which take
+// precedence over the types of the system. They can be overridden with a
+// mime.types file.
+var builtinMimeTypes = map[string]string{
+	".txt":      "text/plain",
+	".log":      "text/plain",
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+	".csv":      "text/csv",
+	".tsv":      "text/tab-separated-values",
+	".json":     "application/json",
+	".xml":      "application/xml",
+	".yaml":     "application/yaml",
+	".yml":      "application/yaml",
+	".toml":     "application/toml",
+	".js":       "application/javascript",
+	".mjs":      "application/javascript",
+	".css":      "text/css",
+	".html":     "text/html",
+	".htm":      "text/html",
+	".svg":      "image/svg+xml",
+	".pdf":      "application/pdf",
+	".wasm":     "application/wasm",
+}
+
+// textTypes are the content types of text that are not text/*
+var textTypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/yaml":       true,
+	"application/toml":       true,
+	"application/javascript": true,
+	"application/x-sh":       true,
+}
+
+// isTextType returns whether a content type is text
+func isTextType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || textTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// loadMimeTypes parses a file in the format of /etc/mime.types, with a
+// content type and its extensions on each line
+func loadMimeTypes(fname string) (types map[string]string, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	types = make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			types["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = fields[0]
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// parseMimeTypesOrWarn loads the mime.types file, if any, and warns when it
+// can not be loaded
+func parseMimeTypesOrWarn(fname string) map[string]string {
+	if fname == "" {
+		return nil
+	}
+	types, err := loadMimeTypes(fname)
+	if err != nil {
+		log.Warnf("mime-types: %s, using the built-in types", err.Error())
+	}
+	return types
+}
+
+// parseDeclaredTypes parses the list of content types that uploaders can
+// declare, like "text/plain,image/*"
+func parseDeclaredTypes(s string) (types []string) {
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			types = append(types, t)
+		}
+	}
+	return
+}
+
+// typeByExtension returns the content type of the extension of a filename,
+// or "" if it is unknown
+func (cfg Config) typeByExtension(fname string) string {
+	ext := strings.ToLower(filepath.Ext(fname))
+	if ext == "" {
+		return ""
+	}
+	if t, ok := cfg.mimeTypes[ext]; ok {
+		return t
+	}
+	if t, ok := builtinMimeTypes[ext]; ok {
+		return t
+	}
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+	return mediaType
+}
+
+// allowsDeclaredType returns whether uploaders can declare a content type.
+// Types like image/* do not include the types that browsers run, like SVG,
+// which have to be listed on their own.
+func (cfg Config) allowsDeclaredType(mediaType string) bool {
+	for _, t := range cfg.declaredTypes {
+		if t == mediaType {
+			return true
+		}
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) && !isActiveType(mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentTypes is how the content type of an upload was resolved
+type contentTypes struct {
+	// ContentType is the content type that the upload is served with
+	ContentType string
+	// Detected is the content type from the data
+	Detected string
+	// Declared is the content type that the uploader sent
+	Declared string
+	// IsText is whether the data is text
+	IsText bool
+}
+
+// resolveContentType resolves the content type of gzipped data from its
+// magic bytes, the content type that the uploader declared and the extension
+// of its filename, in that order. The declared type and the extension are
+// only used when they agree with the data on whether it is text, and the
+// declared type only when it is allowed.
+func resolveContentType(cfg Config, fname string, declared string, file io.Reader) (ct contentTypes, err error) {
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return
+	}
+	defer gz.Close()
+
+	// the file header is in the first 261 bytes, but deciding whether it is
+	// text needs more
+	head := make([]byte, textSampleSize)
+	n, err := io.ReadFull(gz, head)
+	truncated := err == nil
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	} else if err != nil {
+		return
+	}
+	head = head[:n]
+	isText, charset := classifyText(head, truncated)
+	ct.IsText = isText
+
+	kind, err := filetype.Match(head)
+	if err != nil {
+		return
+	}
+	if kind != filetype.Unknown {
+		ct.Detected = kind.MIME.Value
+	} else {
+		ct.Detected = strings.Split(http.DetectContentType(head), ";")[0]
+		if ct.Detected == "application/octet-stream" && isText {
+			ct.Detected = "text/plain"
+		}
+	}
+
+	if declared != "" {
+		ct.Declared, _, _ = mime.ParseMediaType(declared)
+	}
+	byExtension := cfg.typeByExtension(fname)
+	switch {
+	case kind != filetype.Unknown:
+		ct.ContentType = ct.Detected
+	case ct.Declared != "" && cfg.allowsDeclaredType(ct.Declared) && isTextType(ct.Declared) == isText:
+		ct.ContentType = ct.Declared
+	case byExtension != "" && isTextType(byExtension) == isText:
+		ct.ContentType = byExtension
+	case isText:
+		// sniffing HTML in a text file does not make it HTML
+		ct.ContentType = "text/plain"
+	default:
+		ct.ContentType = ct.Detected
+	}
+	if isText && isTextType(ct.ContentType) {
+		ct.ContentType = withCharset(ct.ContentType, charset)
+	}
+	return
+}
+
+// resolveUploadContentType resolves the content type of a gzipped upload
+func resolveUploadContentType(cfg Config, fname string, declared string) (ct contentTypes, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return resolveContentType(cfg, fname, declared, f)
+}
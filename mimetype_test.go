@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gzipped compresses data like an upload
+func gzipped(data []byte) *bytes.Buffer {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(data)
+	gw.Close()
+	return &buf
+}
+
+func TestResolveContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x02\x00\x00\x00")
+	binary := []byte{0x00, 0x01, 0x02, 0x03, 0xfe}
+	cfg := Config{declaredTypes: parseDeclaredTypes(defaultDeclaredTypes), mimeTypes: map[string]string{".conf": "text/x-config"}}
+	tests := []struct {
+		name     string
+		fname    string
+		declared string
+		data     []byte
+		want     string
+	}{
+		{"magic bytes over extension", "a.txt", "", png, "image/png"},
+		{"magic bytes over declared", "a.bin", "application/pdf", png, "image/png"},
+		{"declared over extension", "a.txt", "text/csv", []byte("a,b\n"), "text/csv; charset=utf-8"},
+		{"declared not allowed", "a.txt", "text/html", []byte("<p>hi</p>"), "text/plain; charset=utf-8"},
+		{"declared text for binary", "a.bin", "text/plain", binary, "application/octet-stream"},
+		{"extension", "data.json", "", []byte(`{"a":1}`), "application/json; charset=utf-8"},
+		{"configured extension", "app.conf", "", []byte("a = 1\n"), "text/x-config; charset=utf-8"},
+		{"html extension is not sniffed", "page.html", "", []byte("<html><script>alert(1)</script>"), "text/html; charset=utf-8"},
+		{"sniffed html is text", "page", "", []byte("<html><script>alert(1)</script>"), "text/plain; charset=utf-8"},
+		{"text extension for binary", "a.txt", "", binary, "application/octet-stream"},
+		{"utf-16", "a.txt", "", []byte("\xFF\xFEh\x00i\x00"), "text/plain; charset=utf-16le"},
+		{"unknown binary", "a", "", binary, "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct, err := resolveContentType(cfg, tt.fname, tt.declared, gzipped(tt.data))
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, ct.ContentType)
+		})
+	}
+}
+
+func TestTypeByExtension(t *testing.T) {
+	cfg := Config{mimeTypes: map[string]string{".md": "text/x-markdown"}}
+	for fname, want := range map[string]string{
+		"README.md": "text/x-markdown",
+		"a.YAML":    "application/yaml",
+		"a.png":     "image/png",
+		"a":         "",
+		"a.unknown": "",
+	} {
+		assert.Equal(t, want, cfg.typeByExtension(fname), fname)
+	}
+}
+
+func TestAllowsDeclaredType(t *testing.T) {
+	cfg := Config{declaredTypes: parseDeclaredTypes(" text/plain, IMAGE/*,,application/xml")}
+	for mediaType, want := range map[string]bool{
+		"text/plain":      true,
+		"image/png":       true,
+		"image/svg+xml":   false,
+		"application/xml": true,
+		"text/html":       false,
+		"imagex/png":      false,
+	} {
+		assert.Equal(t, want, cfg.allowsDeclaredType(mediaType), mediaType)
+	}
+	// SVG can be listed on its own
+	cfg = Config{declaredTypes: parseDeclaredTypes("image/*,image/svg+xml")}
+	assert.True(t, cfg.allowsDeclaredType("image/svg+xml"))
+}
+
+func TestLoadMimeTypes(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "mime.types")
+	assert.Nil(t, os.WriteFile(fname, []byte("# comment\ntext/x-config conf .CFG # trailing\napplication/x-empty\n"), 0644))
+	types, err := loadMimeTypes(fname)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{".conf": "text/x-config", ".cfg": "text/x-config"}, types)
+	_, err = loadMimeTypes(fname + ".missing")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/avct/uasurfer"
+)
+
+// clientType is the kind of response that a client wants
+type clientType int
+
+const (
+	// clientRaw wants the bytes of the file
+	clientRaw clientType = iota
+	// clientHTML wants a page to view in the browser
+	clientHTML
+	// clientJSON wants the information as JSON
+	clientJSON
+)
+
+// clientTypes are the names used in the query switches and overrides
+var clientTypes = map[string]clientType{
+	"raw":  clientRaw,
+	"view": clientHTML,
+	"html": clientHTML,
+	"json": clientJSON,
+}
+
+// negotiateClient determines what kind of response the client wants, from
+// (in order) the ?raw, ?view and ?json query switches, the configured
+// User-Agent overrides, whether the User-Agent is a bot that unfurls links
+// (which reads the Open Graph tags of the page), the Accept header and
+// finally from whether the User-Agent is a known browser.
+func negotiateClient(r *http.Request) clientType {
+	query := r.URL.Query()
+	for _, name := range []string{"raw", "view", "json"} {
+		if _, ok := query[name]; ok {
+			return clientTypes[name]
+		}
+	}
+
+	if ct, ok := clientOverride(getConfig().ClientOverrides, r.Header.Get("User-Agent")); ok {
+		return ct
+	}
+
+	if isUnfurler(r.Header.Get("User-Agent")) {
+		return clientHTML
+	}
+
+	if accept := r.Header.Get("Accept"); accept != "" {
+		if ct, ok := negotiateAccept(accept); ok {
+			return ct
+		}
+	}
+
+	ua := uasurfer.Parse(r.Header.Get("User-Agent"))
+	if ua.Browser.Name == uasurfer.BrowserUnknown {
+		return clientRaw
+	}
+	return clientHTML
+}
+
+// clientOverride returns the client type for a User-Agent from a list of
+// overrides like "httpie=raw,PowerShell=raw", matching case-insensitive
+// substrings of the User-Agent.
+func clientOverride(overrides string, userAgent string) (ct clientType, ok bool) {
+	userAgent = strings.ToLower(userAgent)
+	for _, override := range strings.Split(overrides, ",") {
+		kv := strings.SplitN(override, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		match := strings.ToLower(strings.TrimSpace(kv[0]))
+		if match == "" || !strings.Contains(userAgent, match) {
+			continue
+		}
+		ct, ok = clientTypes[strings.ToLower(strings.TrimSpace(kv[1]))]
+		if ok {
+			return
+		}
+	}
+	return
+}
+
+// negotiateAccept determines the client type from the Accept header. The
+// media type with the highest quality (the first one on ties) wins, where
+// HTML and JSON must be asked for explicitly and anything else means the
+// raw data. Browsers always ask for HTML explicitly when navigating, so a
+// header with only "*/*" means the raw data too.
+func negotiateAccept(accept string) (ct clientType, ok bool) {
+	best := 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= best || mediaType == "*/*" || mediaType == "" {
+			continue
+		}
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			ct = clientHTML
+		case "application/json":
+			ct = clientJSON
+		default:
+			ct = clientRaw
+		}
+		best = q
+		ok = true
+	}
+	if !ok && strings.Contains(accept, "*/*") {
+		// e.g. curl, wget and most HTTP libraries
+		return clientRaw, true
+	}
+	return
+}
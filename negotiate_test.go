@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateAccept(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   clientType
+		ok     bool
+	}{
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", clientHTML, true},
+		{"application/json", clientJSON, true},
+		{"application/json;q=0.5, text/html;q=0.9", clientHTML, true},
+		{"text/html;q=0.5, application/json", clientJSON, true},
+		{"text/html, application/json", clientHTML, true},
+		{"image/png", clientRaw, true},
+		{"*/*", clientRaw, true},
+		{"*/*;q=0.1, application/json; q=0.2", clientJSON, true},
+		{"", clientRaw, false},
+		{"nonsense;q=0", clientRaw, false},
+	}
+	for _, tt := range tests {
+		ct, ok := negotiateAccept(tt.accept)
+		assert.Equal(t, tt.ok, ok, tt.accept)
+		if tt.ok {
+			assert.Equal(t, tt.want, ct, tt.accept)
+		}
+	}
+}
+
+func TestClientOverride(t *testing.T) {
+	overrides := "httpie=raw, PowerShell = json,broken,=view,curl=nonsense"
+	tests := []struct {
+		userAgent string
+		want      clientType
+		ok        bool
+	}{
+		{"HTTPie/3.2.1", clientRaw, true},
+		{"Mozilla/5.0 (Windows NT; Windows NT 10.0) WindowsPowerShell/5.1", clientJSON, true},
+		{"curl/8.0", clientRaw, false},
+		{"Mozilla/5.0 Firefox/120", clientRaw, false},
+	}
+	for _, tt := range tests {
+		ct, ok := clientOverride(overrides, tt.userAgent)
+		assert.Equal(t, tt.ok, ok, tt.userAgent)
+		assert.Equal(t, tt.want, ct, tt.userAgent)
+	}
+}
+
+func TestNegotiateClient(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.ClientOverrides = "httpie=view"
+	setConfig(cfg)
+	const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"
+	tests := []struct {
+		name      string
+		query     string
+		userAgent string
+		accept    string
+		want      clientType
+	}{
+		{"curl", "", "curl/8.0", "*/*", clientRaw},
+		{"browser", "", firefox, "text/html,*/*;q=0.8", clientHTML},
+		{"browser fetching json", "", firefox, "application/json", clientJSON},
+		{"browser without accept", "", firefox, "", clientHTML},
+		{"unknown without accept", "", "", "", clientRaw},
+		{"raw switch", "?raw", firefox, "text/html", clientRaw},
+		{"view switch", "?view", "curl/8.0", "*/*", clientHTML},
+		{"json switch", "?json", firefox, "text/html", clientJSON},
+		{"override", "", "HTTPie/3.2.1", "application/json", clientHTML},
+		{"unfurler", "", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", "*/*", clientHTML},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/123/a.txt"+tt.query, nil)
+		r.Header.Set("User-Agent", tt.userAgent)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		assert.Equal(t, tt.want, negotiateClient(r), tt.name)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/chroma/v2/lexers"
+	log "github.com/schollz/logger"
+)
+
+// pasteName is the name of pastes without a filename
+const pasteName = "paste"
+
+// pasteFilename returns the filename of a paste, using the extension of the
+// language if the filename has none
+func pasteFilename(filename string, language string) string {
+	filename = strings.TrimSpace(filename)
+	if filename == "" {
+		filename = pasteName
+	}
+	filename, _ = filepath.Abs(filename)
+	_, filename = filepath.Split(filename)
+	if filepath.Ext(filename) != "" {
+		return filename
+	}
+	ext := ".txt"
+	if lexer := lexers.Get(strings.TrimSpace(language)); language != "" && lexer != nil {
+		for _, pattern := range lexer.Config().Filenames {
+			if strings.HasPrefix(pattern, "*.") && !strings.ContainsAny(pattern[2:], "*?[") {
+				ext = pattern[1:]
+				break
+			}
+		}
+	}
+	return filename + ext
+}
+
+// readPaste reads the text of a paste, which is the "text" field of a form
+// (like the one on the home page) or else the whole body. curl sends bodies
+// as urlencoded forms, so those without a "text" field are the text.
+func readPaste(r *http.Request, max int64) (text []byte, filename string, language string, err error) {
+	query := r.URL.Query()
+	filename, language = query.Get("filename"), query.Get("language")
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var form url.Values
+	if mediaType == "multipart/form-data" {
+		r.Body = http.MaxBytesReader(nil, r.Body, max)
+		if err = r.ParseMultipartForm(32 << 20); err != nil {
+			return
+		}
+		form = r.PostForm
+	} else {
+		var buf bytes.Buffer
+		if _, err = CopyMax(&buf, r.Body, max); err != nil {
+			return
+		}
+		text = buf.Bytes()
+		if mediaType != "application/x-www-form-urlencoded" {
+			return
+		}
+		form, _ = url.ParseQuery(buf.String())
+	}
+	if !form.Has("text") {
+		return
+	}
+	// browsers send the lines of a textarea with CRLF
+	text = []byte(strings.ReplaceAll(form.Get("text"), "\r\n", "\n"))
+	if form.Get("filename") != "" {
+		filename = form.Get("filename")
+	}
+	if form.Get("language") != "" {
+		language = form.Get("language")
+	}
+	return
+}
+
+// handlePaste handles POST /paste, which creates a share from text that is
+// posted from the form on the home page or as the body of the request:
+//
+//	echo hello | curl --data-binary @- host/paste
+func handlePaste(w http.ResponseWriter, r *http.Request) (err error) {
+	if refuseUploadsWhenShuttingDown(w) {
+		return nil
+	}
+	p := newRequestPage(r)
+	start := time.Now()
+	throttleUpload(r)
+	text, filename, language, err := readPaste(r, p.Config.MaxBytesPerFile)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if len(bytes.TrimSpace(text)) == 0 {
+		return fmt.Errorf("Nothing to paste.")
+	}
+
+	p.Name, err = writeAllBytes(pasteFilename(filename, language), bytes.NewReader(text), uploadOptions{Uploader: clientIP(r)})
+	if err != nil {
+		return
+	}
+	observeUpload(uploadMethodPaste, int64(len(text)), start)
+	auditUpload(r, p.Name)
+
+	if negotiateClient(r) == clientHTML {
+		http.Redirect(w, r, p.Config.BasePath+"/"+p.Name, http.StatusSeeOther)
+		return
+	}
+	_, err = io.WriteString(w, p.Config.PublicURL+"/"+p.Name+"\n")
+	return
+}
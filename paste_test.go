@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasteFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		language string
+		want     string
+	}{
+		{"", "", "paste.txt"},
+		{"", "go", "paste.go"},
+		{"", "nonsense", "paste.txt"},
+		{"notes", "", "notes.txt"},
+		{"main.py", "go", "main.py"},
+		{"../../etc/passwd", "", "passwd.txt"},
+		{" hello.txt ", "", "hello.txt"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, pasteFilename(tt.filename, tt.language), tt.filename+" "+tt.language)
+	}
+}
+
+func TestReadPaste(t *testing.T) {
+	multipartBody := func(fields map[string]string) (string, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for k, v := range fields {
+			mw.WriteField(k, v)
+		}
+		mw.Close()
+		return buf.String(), mw.FormDataContentType()
+	}
+	multipartForm, multipartType := multipartBody(map[string]string{"text": "a\r\nb", "filename": "form.txt"})
+	tests := []struct {
+		name         string
+		query        string
+		contentType  string
+		body         string
+		wantText     string
+		wantFilename string
+		wantLanguage string
+		wantErr      bool
+	}{
+		{"body", "?filename=a.go", "text/plain", "x := 1\r\n", "x := 1\r\n", "a.go", "", false},
+		{"body without type", "?language=go", "", "text=not a form", "text=not a form", "", "go", false},
+		{"body with text=", "", "application/octet-stream", "a=1&text=2", "a=1&text=2", "", "", false},
+		{"urlencoded form", "?filename=query.txt", "application/x-www-form-urlencoded", "text=a%0D%0Ab&language=go", "a\nb", "query.txt", "go", false},
+		{"urlencoded without text", "", "application/x-www-form-urlencoded", "hello", "hello", "", "", false},
+		{"curl --data-binary", "", "application/x-www-form-urlencoded", "foo\r\nbar=1&filename=x\n", "foo\r\nbar=1&filename=x\n", "", "", false},
+		{"multipart form", "", multipartType, multipartForm, "a\nb", "form.txt", "", false},
+		{"too big", "", "text/plain", strings.Repeat("x", 2000), "", "", "", true},
+		{"too big form", "", "application/x-www-form-urlencoded", "text=" + strings.Repeat("x", 2000), "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/paste"+tt.query, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			text, filename, language, err := readPaste(r, 1000)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantText, string(text))
+			assert.Equal(t, tt.wantFilename, filename)
+			assert.Equal(t, tt.wantLanguage, language)
+		})
+	}
+}
+
+func TestPasteWithCurl(t *testing.T) {
+	curl, err := exec.LookPath("curl")
+	if err != nil {
+		t.Skip("curl is not installed")
+	}
+	useTestConfig(t)
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	// the example of the paste endpoint
+	cmd := exec.Command(curl, "-s", "--data-binary", "@-", server.URL+"/paste")
+	cmd.Stdin = strings.NewReader("foo\n")
+	out, err := cmd.Output()
+	assert.Nil(t, err)
+	link := strings.TrimSpace(string(out))
+	assert.True(t, strings.HasSuffix(link, "/"+pasteName+".txt"), link)
+
+	parts := strings.Split(link, "/")
+	p, err := loadPageInfo(parts[len(parts)-2])
+	assert.Nil(t, err)
+	b, err := p.readData(-1)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo\n", string(b))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	log "github.com/schollz/logger"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// kinds of previews of uploads
+const (
+	previewImage    = "image"
+	previewAudio    = "audio"
+	previewVideo    = "video"
+	previewPDF      = "pdf"
+	previewMarkdown = "markdown"
+	previewText     = "text"
+	previewHex      = "hex"
+)
+
+// size limits of the previews
+const (
+	maxMarkdownPreview = 1000000
+	hexDumpBytes       = 4096
+)
+
+// markdown renders GitHub flavored Markdown, the HTML is sanitized after
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// markdownPolicy is what HTML is allowed in rendered Markdown
+var markdownPolicy = bluemonday.UGCPolicy()
+
+// previewKind returns how an upload is shown in the browser
+func (p *Page) previewKind() string {
+	ext := strings.ToLower(filepath.Ext(p.Name))
+	switch {
+	case p.IsASCII && (ext == ".md" || ext == ".markdown") && p.Size < maxMarkdownPreview:
+		return previewMarkdown
+	case p.IsImage:
+		return previewImage
+	case p.IsAudio:
+		return previewAudio
+	case p.IsVideo:
+		return previewVideo
+	case p.ContentType == "application/pdf" && p.Config.userContentHost != "":
+		// PDFs are only shown from the usercontent domain
+		return previewPDF
+	case p.IsASCII:
+		return previewText
+	}
+	return previewHex
+}
+
+// StreamLink is the link to the decompressed data, which supports range
+// requests for seeking in audio and video
+func (p *Page) StreamLink() string {
+	return "/stream/" + p.ID + "/" + p.Name
+}
+
+// loadPreview loads what is needed to show the preview of the upload
+func (p *Page) loadPreview() (err error) {
+	p.Preview = p.previewKind()
+	switch p.Preview {
+	case previewText:
+		p.HTML, p.NextLine, err = p.highlightLines(1)
+	case previewMarkdown:
+		var b []byte
+		b, err = p.readText(-1)
+		if err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		err = markdown.Convert(b, &buf)
+		if err != nil {
+			return
+		}
+		p.HTML = template.HTML(markdownPolicy.SanitizeBytes(buf.Bytes()))
+	case previewHex:
+		var b []byte
+		b, err = p.readData(hexDumpBytes)
+		if err != nil {
+			return
+		}
+		p.HexDump = hex.Dump(b)
+	}
+	return
+}
+
+// gzipFile is the decompressed data of an upload. It can seek, for range
+// requests, by decompressing up to the position (from the start again to
+// go backwards), so that no decompressed copy has to be stored.
+type gzipFile struct {
+	*gzip.Reader
+	f      *os.File
+	size   int64
+	pos    int64 // where the decompression is
+	offset int64 // where the next read starts
+}
+
+func (gf *gzipFile) Read(b []byte) (n int, err error) {
+	if gf.offset < gf.pos {
+		if _, err = gf.f.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		if err = gf.Reader.Reset(gf.f); err != nil {
+			return
+		}
+		gf.pos = 0
+	}
+	if gf.offset > gf.pos {
+		var skipped int64
+		skipped, err = io.CopyN(io.Discard, gf.Reader, gf.offset-gf.pos)
+		gf.pos += skipped
+		if err != nil {
+			return
+		}
+	}
+	n, err = gf.Reader.Read(b)
+	gf.pos += int64(n)
+	gf.offset = gf.pos
+	return
+}
+
+// Seek sets where the next read starts, the end is the size of the upload
+func (gf *gzipFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += gf.offset
+	case io.SeekEnd:
+		offset += gf.size
+	}
+	if offset < 0 {
+		return gf.offset, errors.New("seek before the start of the data")
+	}
+	gf.offset = offset
+	return offset, nil
+}
+
+func (gf *gzipFile) Close() error {
+	gf.Reader.Close()
+	return gf.f.Close()
+}
+
+// openData opens the decompressed data of the upload
+func (p *Page) openData() (rc io.ReadSeekCloser, err error) {
+	f, err := os.Open(p.NameOnDisk)
+	if err != nil {
+		return
+	}
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return
+	}
+	return &gzipFile{Reader: gr, f: f, size: p.Size}, nil
+}
+
+// readData reads the decompressed data, up to max bytes (all of it if max
+// is negative)
+func (p *Page) readData(max int64) (b []byte, err error) {
+	rc, err := p.openData()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if max >= 0 {
+		r = io.LimitReader(rc, max)
+	}
+	return io.ReadAll(r)
+}
+
+// readText reads the decompressed text as UTF-8, up to max bytes of the
+// data (all of it if max is negative)
+func (p *Page) readText(max int64) (b []byte, err error) {
+	b, err = p.readData(max)
+	if err != nil {
+		return
+	}
+	return io.ReadAll(p.decodeText(bytes.NewReader(b)))
+}
+
+// handleStream handles GET /stream/<id>/<filename> and returns the
+// decompressed data with support for range requests
+func handleStream(w http.ResponseWriter, r *http.Request) (err error) {
+	p, err := loadRequestPage(r)
+	if err != nil {
+		return
+	}
+	if p.refuseUnscanned(w, r) {
+		return
+	}
+	rc, err := p.openData()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer rc.Close()
+
+	p.setUserContentHeaders(w)
+	w.Header().Set("ETag", `"`+p.Hash+`"`)
+	p.setUploadCacheControl(w)
+	rec := &responseRecorder{ResponseWriter: throttleResponse(w, r, downloadBandwidth(r, p.Config))}
+	http.ServeContent(rec, r, p.Name, p.Modified, rc)
+	observeDownload(r, rec.Bytes)
+	if rangeHeader := r.Header.Get("Range"); r.Method == http.MethodGet && (rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-")) {
+		// players make many range requests, only count the first
+		auditRequest(r, auditEventDownload, p)
+	}
+	return
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestUpload stores data gzipped like an upload and returns its page
+func writeTestUpload(t *testing.T, id string, name string, data []byte) *Page {
+	cfg := getConfig()
+	dir := path.Join(cfg.ContentDirectory, id)
+	assert.Nil(t, os.MkdirAll(dir, 0755))
+	assert.Nil(t, os.WriteFile(path.Join(dir, name), gzipped(data).Bytes(), 0644))
+	return &Page{
+		ID:         id,
+		Name:       name,
+		Size:       int64(len(data)),
+		Modified:   time.Now(),
+		NameOnDisk: path.Join(dir, name),
+		Config:     cfg,
+	}
+}
+
+func TestGzipFileSeek(t *testing.T) {
+	useTestConfig(t)
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	p := writeTestUpload(t, "abc", "data.bin", data)
+	rc, err := p.openData()
+	assert.Nil(t, err)
+	defer rc.Close()
+
+	tests := []struct {
+		offset  int64
+		whence  int
+		wantPos int64
+	}{
+		{0, io.SeekEnd, 100000},
+		{-10, io.SeekEnd, 99990},
+		{50000, io.SeekStart, 50000},
+		{100, io.SeekCurrent, 50110},
+		{10, io.SeekStart, 10},
+		{0, io.SeekStart, 0},
+	}
+	for _, tt := range tests {
+		pos, err := rc.Seek(tt.offset, tt.whence)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.wantPos, pos)
+		b := make([]byte, 10)
+		n, err := io.ReadFull(rc, b)
+		if tt.wantPos >= int64(len(data)) {
+			assert.Equal(t, 0, n)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, data[pos:pos+10], b)
+	}
+	_, err = rc.Seek(-1, io.SeekStart)
+	assert.NotNil(t, err)
+}
+
+func TestServeGzipFile(t *testing.T) {
+	useTestConfig(t)
+	p := writeTestUpload(t, "abc", "a.txt", []byte("0123456789"))
+	tests := []struct {
+		rangeHeader string
+		want        int
+		wantBody    string
+	}{
+		{"", http.StatusOK, "0123456789"},
+		{"bytes=2-4", http.StatusPartialContent, "234"},
+		{"bytes=-3", http.StatusPartialContent, "789"},
+		{"bytes=8-", http.StatusPartialContent, "89"},
+		{"bytes=20-", http.StatusRequestedRangeNotSatisfiable, ""},
+	}
+	for _, tt := range tests {
+		rc, err := p.openData()
+		assert.Nil(t, err)
+		r := httptest.NewRequest("GET", "/stream/abc/a.txt", nil)
+		if tt.rangeHeader != "" {
+			r.Header.Set("Range", tt.rangeHeader)
+		}
+		w := httptest.NewRecorder()
+		http.ServeContent(w, r, p.Name, p.Modified, rc)
+		rc.Close()
+		assert.Equal(t, tt.want, w.Code, tt.rangeHeader)
+		if tt.want != http.StatusRequestedRangeNotSatisfiable {
+			assert.Equal(t, tt.wantBody, w.Body.String(), tt.rangeHeader)
+		}
+	}
+}
+
+func TestPreviewKind(t *testing.T) {
+	tests := []struct {
+		p    Page
+		want string
+	}{
+		{Page{Name: "README.md", IsASCII: true, IsText: true, Size: 100}, previewMarkdown},
+		{Page{Name: "big.md", IsASCII: true, IsText: true, Size: maxMarkdownPreview}, previewText},
+		{Page{Name: "a.png", IsImage: true}, previewImage},
+		{Page{Name: "a.mp3", IsAudio: true}, previewAudio},
+		{Page{Name: "a.mp4", IsVideo: true}, previewVideo},
+		{Page{Name: "a.pdf", ContentType: "application/pdf", Config: Config{userContentHost: "usercontent.example.com"}}, previewPDF},
+		{Page{Name: "a.pdf", ContentType: "application/pdf"}, previewHex},
+		{Page{Name: "main.go", IsASCII: true, IsText: true}, previewText},
+		{Page{Name: "a.bin"}, previewHex},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.p.previewKind(), tt.p.Name)
+	}
+}
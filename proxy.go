@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// normalizeBasePath returns the base path with a leading slash and
+// without a trailing slash, e.g. "share/" becomes "/share" and "/"
+// becomes "".
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// parseTrustedProxies parses a comma-separated list of IPs and CIDRs.
+func parseTrustedProxies(s string) (nets []*net.IPNet) {
+	for _, proxy := range strings.Split(s, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return
+}
+
+// isTrustedProxy returns whether the address belongs to a trusted proxy
+func (cfg Config) isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range cfg.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the host part of the remote address of the request
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedParams returns the parameters of the Forwarded header (RFC 7239)
+// in order, so the last element was added by the closest proxy.
+func forwardedParams(r *http.Request) (params []map[string]string) {
+	for _, header := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			param := make(map[string]string)
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				param[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+			params = append(params, param)
+		}
+	}
+	return
+}
+
+// forwardedFor returns the chain of client addresses from the Forwarded
+// or X-Forwarded-For headers.
+func forwardedFor(r *http.Request) (addrs []string) {
+	if params := forwardedParams(r); len(params) > 0 {
+		for _, param := range params {
+			addr := param["for"]
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+			addrs = append(addrs, strings.Trim(addr, "[]"))
+		}
+		return
+	}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
+	}
+	return
+}
+
+// clientIP returns the IP of the client. The forwarding headers are only
+// used when the request comes from a trusted proxy, and then the first
+// address that is not a trusted proxy (from the right) is the client.
+func clientIP(r *http.Request) string {
+	cfg := getConfig()
+	ip := remoteHost(r)
+	if !cfg.isTrustedProxy(ip) {
+		return ip
+	}
+	addrs := forwardedFor(r)
+	for i := len(addrs) - 1; i >= 0; i-- {
+		if addrs[i] == "" {
+			continue
+		}
+		ip = addrs[i]
+		if !cfg.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedValue returns the value of a forwarding parameter set by a
+// trusted proxy, from either the Forwarded header or the corresponding
+// X-Forwarded-* header, or an empty string. For both headers this is the
+// right-most value, which was added by the closest proxy; the ones before
+// it could have come from the client.
+func forwardedValue(r *http.Request, name string, header string) string {
+	cfg := getConfig()
+	if !cfg.isTrustedProxy(remoteHost(r)) {
+		return ""
+	}
+	if params := forwardedParams(r); len(params) > 0 {
+		return params[len(params)-1][name]
+	}
+	values := r.Header.Values(header)
+	if len(values) == 0 {
+		return ""
+	}
+	value := values[len(values)-1]
+	if i := strings.LastIndex(value, ","); i >= 0 {
+		value = value[i+1:]
+	}
+	return strings.TrimSpace(value)
+}
+
+// requestScheme returns the scheme that the client used
+func requestScheme(r *http.Request) string {
+	if proto := forwardedValue(r, "proto", "X-Forwarded-Proto"); proto != "" {
+		return strings.ToLower(proto)
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestHost returns the host that the client used
+func requestHost(r *http.Request) string {
+	if host := forwardedValue(r, "host", "X-Forwarded-Host"); host != "" {
+		return host
+	}
+	return r.Host
+}
+
+// publicURL returns the URL under which share is reachable for the client,
+// including the base path. The configured public URL is used when it was
+// set explicitly. Otherwise it is derived from requests that come through a
+// trusted proxy, since the Host header of anyone else could point the links
+// of share anywhere, and is the default public URL for the others.
+func publicURL(r *http.Request) string {
+	cfg := getConfig()
+	base := strings.TrimSuffix(cfg.PublicURL, "/")
+	if !cfg.publicURLSet && r.Host != "" && cfg.isTrustedProxy(remoteHost(r)) {
+		base = requestScheme(r) + "://" + requestHost(r)
+	}
+	if !strings.HasSuffix(base, cfg.BasePath) {
+		base += cfg.BasePath
+	}
+	return base
+}
+
+// stripBasePath removes the base path from the request path, so that
+// share works both when the proxy passes the prefix along and when it
+// strips it.
+func stripBasePath(r *http.Request) {
+	basePath := getConfig().BasePath
+	if basePath == "" {
+		return
+	}
+	if r.URL.Path == basePath {
+		r.URL.Path = "/"
+	} else if strings.HasPrefix(r.URL.Path, basePath+"/") {
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, basePath)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeBasePath(t *testing.T) {
+	for in, want := range map[string]string{
+		"":        "",
+		"/":       "",
+		"share":   "/share",
+		"/share/": "/share",
+		"a/b/":    "/a/b",
+	} {
+		assert.Equal(t, want, normalizeBasePath(in), in)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	cfg := Config{trustedProxies: parseTrustedProxies("10.0.0.1, 192.168.0.0/16,::1,nonsense")}
+	assert.Len(t, cfg.trustedProxies, 3)
+	assert.True(t, cfg.isTrustedProxy("10.0.0.1"))
+	assert.False(t, cfg.isTrustedProxy("10.0.0.2"))
+	assert.True(t, cfg.isTrustedProxy("192.168.3.4"))
+	assert.True(t, cfg.isTrustedProxy("[::1]"))
+	assert.False(t, cfg.isTrustedProxy("unix"))
+}
+
+// withProxyConfig sets a configuration that trusts the proxy at 10.0.0.1
+func withProxyConfig(t *testing.T, publicURL string, basePath string) {
+	cfg := testConfig(t.TempDir())
+	cfg.TrustedProxies = "10.0.0.1"
+	cfg.PublicURL = publicURL
+	cfg.BasePath = basePath
+	finalizeConfig(&cfg)
+	old := getConfig()
+	t.Cleanup(func() { setConfig(old) })
+	setConfig(cfg)
+}
+
+func TestForwarding(t *testing.T) {
+	tests := []struct {
+		name       string
+		remote     string
+		headers    map[string][]string
+		wantIP     string
+		wantScheme string
+		wantHost   string
+	}{
+		{
+			name:       "direct",
+			remote:     "1.2.3.4:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"6.6.6.6"}, "X-Forwarded-Host": {"evil.example.com"}},
+			wantIP:     "1.2.3.4",
+			wantScheme: "http",
+			wantHost:   "share.example.com",
+		},
+		{
+			name:   "x-forwarded",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For":   {"6.6.6.6, 1.2.3.4"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"evil.example.com, proxied.example.com"},
+			},
+			wantIP:     "1.2.3.4",
+			wantScheme: "https",
+			wantHost:   "proxied.example.com",
+		},
+		{
+			name:   "x-forwarded over several lines",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"X-Forwarded-For":  {"6.6.6.6", "1.2.3.4, 10.0.0.1"},
+				"X-Forwarded-Host": {"evil.example.com", "proxied.example.com"},
+			},
+			wantIP:     "1.2.3.4",
+			wantScheme: "http",
+			wantHost:   "proxied.example.com",
+		},
+		{
+			name:   "forwarded",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"Forwarded": {`for=6.6.6.6;host=evil.example.com, for="[2001:db8::1]:4711";proto=https;host=proxied.example.com`},
+			},
+			wantIP:     "2001:db8::1",
+			wantScheme: "https",
+			wantHost:   "proxied.example.com",
+		},
+	}
+	withProxyConfig(t, "", "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://share.example.com/", nil)
+			r.RemoteAddr = tt.remote
+			for k, values := range tt.headers {
+				for _, v := range values {
+					r.Header.Add(k, v)
+				}
+			}
+			assert.Equal(t, tt.wantIP, clientIP(r))
+			assert.Equal(t, tt.wantScheme, requestScheme(r))
+			assert.Equal(t, tt.wantHost, requestHost(r))
+		})
+	}
+}
+
+func TestPublicURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicURL string
+		basePath  string
+		remote    string
+		want      string
+	}{
+		{"set", "https://share.example.com/", "", "10.0.0.1:5000", "https://share.example.com"},
+		{"set with base path", "https://example.com", "/share", "1.2.3.4:5000", "https://example.com/share"},
+		{"from trusted proxy", "", "/share", "10.0.0.1:5000", "https://proxied.example.com/share"},
+		{"not from a proxy", "", "", "1.2.3.4:5000", "http://localhost:8222"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withProxyConfig(t, tt.publicURL, tt.basePath)
+			r := httptest.NewRequest("GET", "http://evil.example.com/", nil)
+			r.RemoteAddr = tt.remote
+			r.Header.Set("X-Forwarded-Proto", "https")
+			r.Header.Set("X-Forwarded-Host", "proxied.example.com")
+			assert.Equal(t, tt.want, publicURL(r))
+		})
+	}
+}
+
+func TestStripBasePath(t *testing.T) {
+	withProxyConfig(t, "", "/share")
+	for in, want := range map[string]string{
+		"/share":           "/",
+		"/share/":          "/",
+		"/share/123/a.txt": "/123/a.txt",
+		"/123/a.txt":       "/123/a.txt",
+		"/shared/a":        "/shared/a",
+	} {
+		r := httptest.NewRequest("GET", in, nil)
+		stripBasePath(r)
+		assert.Equal(t, want, r.URL.Path, in)
+	}
+}
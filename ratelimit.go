@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/schollz/logger"
+	"golang.org/x/time/rate"
+)
+
+// rateSpec is a token bucket rate limit, parsed from e.g. "30/m" for 30
+// requests per minute (with bursts of 30). The zero value means no limit.
+type rateSpec struct {
+	Limit rate.Limit
+	Burst int
+}
+
+// parseRate parses a rate limit like "30/m", "5/s" or "1000/h". An empty
+// string or "0" means no limit.
+func parseRate(s string) (spec rateSpec, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return
+	}
+	parts := strings.SplitN(s, "/", 2)
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 0 {
+		return spec, fmt.Errorf("invalid rate limit %q", s)
+	}
+	per := time.Second
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "s":
+		case "m":
+			per = time.Minute
+		case "h":
+			per = time.Hour
+		default:
+			return spec, fmt.Errorf("invalid rate limit %q, use /s, /m or /h", s)
+		}
+	}
+	spec.Limit = rate.Limit(float64(n) / per.Seconds())
+	spec.Burst = n
+	return
+}
+
+// parseRateOrWarn parses a rate limit, disabling it when it is invalid
+func parseRateOrWarn(name string, s string) rateSpec {
+	spec, err := parseRate(s)
+	if err != nil {
+		log.Warnf("%s: %s, not limiting", name, err.Error())
+	}
+	return spec
+}
+
+// limiterSet holds a token bucket per client
+type limiterSet struct {
+	sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newLimiterSet() *limiterSet {
+	return &limiterSet{buckets: make(map[string]*bucket)}
+}
+
+// the rate limits of share, per client
+var (
+	uploadLimiters   = newLimiterSet()
+	downloadLimiters = newLimiterSet()
+	lookupLimiters   = newLimiterSet()
+	existsLimiters   = newLimiterSet()
+	reportLimiters   = newLimiterSet()
+)
+
+// get returns the limiter of a client, updated to the current limit
+func (ls *limiterSet) get(key string, spec rateSpec) *rate.Limiter {
+	ls.Lock()
+	defer ls.Unlock()
+	b, ok := ls.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(spec.Limit, spec.Burst)}
+		ls.buckets[key] = b
+	} else if b.limiter.Limit() != spec.Limit || b.limiter.Burst() != spec.Burst {
+		// the config was reloaded
+		b.limiter.SetLimit(spec.Limit)
+		b.limiter.SetBurst(spec.Burst)
+	}
+	b.lastSeen = time.Now()
+	return b.limiter
+}
+
+// Allow takes a token from the bucket of a client, or returns how long to
+// wait for one
+func (ls *limiterSet) Allow(key string, spec rateSpec) (ok bool, retryAfter time.Duration) {
+	if spec.Limit == 0 {
+		return true, 0
+	}
+	res := ls.get(key, spec).Reserve()
+	if !res.OK() {
+		return false, time.Minute
+	}
+	if delay := res.Delay(); delay > 0 {
+		res.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// Exhausted returns whether the bucket of a client is empty, and how long
+// until it is not, without taking a token
+func (ls *limiterSet) Exhausted(key string, spec rateSpec) (exhausted bool, retryAfter time.Duration) {
+	if spec.Limit == 0 {
+		return false, 0
+	}
+	tokens := ls.get(key, spec).Tokens()
+	if tokens >= 1 {
+		return false, 0
+	}
+	return true, time.Duration((1 - tokens) / float64(spec.Limit) * float64(time.Second))
+}
+
+// Evict forgets the buckets of clients that have not been seen for a while
+// and whose buckets are full again
+func (ls *limiterSet) Evict(idle time.Duration) {
+	ls.Lock()
+	defer ls.Unlock()
+	for key, b := range ls.buckets {
+		if time.Since(b.lastSeen) > idle && b.limiter.Tokens() >= float64(b.limiter.Burst()) {
+			delete(ls.buckets, key)
+		}
+	}
+}
+
+// evictIdleLimiters periodically forgets idle clients
+func evictIdleLimiters() {
+	for range time.Tick(time.Minute) {
+		for _, ls := range []*limiterSet{uploadLimiters, downloadLimiters, lookupLimiters, existsLimiters, reportLimiters} {
+			ls.Evict(10 * time.Minute)
+		}
+	}
+}
+
+// apiToken returns the API token of the request, if it is one of the
+// configured tokens
+func apiToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	for _, t := range strings.Split(getConfig().APITokens, ",") {
+		if t = strings.TrimSpace(t); t != "" && t == token {
+			return token
+		}
+	}
+	return ""
+}
+
+// rateLimitKey identifies the client of a request for rate limiting: by
+// its API token if it has one, or else by its IP
+func rateLimitKey(r *http.Request) string {
+	if token := apiToken(r); token != "" {
+		return "token:" + token
+	}
+	return "ip:" + clientIP(r)
+}
+
+// tooManyRequests answers with 429 and when to retry
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	metricRateLimited.WithLabelValues(routeName(r)).Inc()
+	jsonResponse(w, http.StatusTooManyRequests, map[string]string{"message": "Too many requests, please slow down."})
+}
+
+// limitRate is the middleware that limits the rate of requests per client
+func limitRate(ls *limiterSet, spec func(cfg Config) rateSpec) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, retryAfter := ls.Allow(rateLimitKey(r), spec(getConfig())); !ok {
+				tooManyRequests(w, r, retryAfter)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitDownloads is the middleware that limits the rate of downloads per
+// client
+var limitDownloads = limitRate(downloadLimiters, func(cfg Config) rateSpec { return cfg.rateDownloads })
+
+// limitNotFound is the middleware that limits the rate of lookups of IDs
+// that do not exist per client, to stop the enumeration of uploads
+func limitNotFound(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := rateLimitKey(r)
+		spec := getConfig().rateLookups
+		if exhausted, retryAfter := lookupLimiters.Exhausted(key, spec); exhausted {
+			tooManyRequests(w, r, retryAfter)
+			return
+		}
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.Status == http.StatusNotFound {
+			lookupLimiters.Allow(key, spec)
+		}
+	})
+}
+
+// activeUploads counts the uploads in progress per client
+var activeUploads = struct {
+	sync.Mutex
+	clients map[string]int
+}{clients: make(map[string]int)}
+
+// limitConcurrentUploads is the middleware that caps the number of uploads
+// that a client can make at the same time
+func limitConcurrentUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		max := getConfig().MaxConcurrentUploads
+		if max <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := rateLimitKey(r)
+		activeUploads.Lock()
+		if activeUploads.clients[key] >= max {
+			activeUploads.Unlock()
+			tooManyRequests(w, r, 5*time.Second)
+			return
+		}
+		activeUploads.clients[key]++
+		activeUploads.Unlock()
+		defer func() {
+			activeUploads.Lock()
+			activeUploads.clients[key]--
+			if activeUploads.clients[key] <= 0 {
+				delete(activeUploads.clients, key)
+			}
+			activeUploads.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startUploadSession registers a new chunked upload of a client, unless
+// the client is over the upload rate or already has the maximum number of
+// chunked uploads in progress. The chunks of an upload that is registered
+// are always accepted.
+func startUploadSession(uuid string, key string, cfg Config) (ok bool, retryAfter time.Duration) {
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+	if _, ok = uploadsClients[uuid]; ok {
+		return
+	}
+	if cfg.MaxConcurrentUploads > 0 {
+		n := 0
+		for other, otherKey := range uploadsClients {
+			// abandoned uploads stop counting after a while
+			if otherKey == key && time.Since(uploadsStarted[other]) < time.Hour {
+				n++
+			}
+		}
+		if n >= cfg.MaxConcurrentUploads {
+			return false, 5 * time.Second
+		}
+	}
+	if ok, retryAfter = uploadLimiters.Allow(key, cfg.rateUploads); !ok {
+		return
+	}
+	uploadsClients[uuid] = key
+	if _, started := uploadsStarted[uuid]; !started {
+		uploadsStarted[uuid] = time.Now()
+	}
+	return true, 0
+}
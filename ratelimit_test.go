@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    rateSpec
+		wantErr bool
+	}{
+		{"", rateSpec{}, false},
+		{"0", rateSpec{}, false},
+		{"5", rateSpec{Limit: 5, Burst: 5}, false},
+		{"5/s", rateSpec{Limit: 5, Burst: 5}, false},
+		{" 30/m ", rateSpec{Limit: 0.5, Burst: 30}, false},
+		{"3600/h", rateSpec{Limit: 1, Burst: 3600}, false},
+		{"5/d", rateSpec{}, true},
+		{"-1/s", rateSpec{}, true},
+		{"lots", rateSpec{}, true},
+	}
+	for _, tt := range tests {
+		spec, err := parseRate(tt.s)
+		assert.Equal(t, tt.wantErr, err != nil, tt.s)
+		if !tt.wantErr {
+			assert.Equal(t, tt.want, spec, tt.s)
+		}
+	}
+}
+
+func TestLimiterSet(t *testing.T) {
+	ls := newLimiterSet()
+	spec := rateSpec{Limit: rate.Limit(1.0 / 60), Burst: 2}
+	for i, want := range []bool{true, true, false} {
+		ok, retryAfter := ls.Allow("a", spec)
+		assert.Equal(t, want, ok, i)
+		if !want {
+			assert.InDelta(t, time.Minute.Seconds(), retryAfter.Seconds(), 1)
+		}
+	}
+	// the buckets are per client
+	ok, _ := ls.Allow("b", spec)
+	assert.True(t, ok)
+	// no limit
+	ok, _ = ls.Allow("a", rateSpec{})
+	assert.True(t, ok)
+
+	exhausted, retryAfter := ls.Exhausted("a", spec)
+	assert.True(t, exhausted)
+	assert.InDelta(t, time.Minute.Seconds(), retryAfter.Seconds(), 1)
+	exhausted, _ = ls.Exhausted("c", spec)
+	assert.False(t, exhausted)
+
+	// a reloaded config changes the buckets
+	limiter := ls.get("a", rateSpec{Limit: 1000, Burst: 1000})
+	assert.Equal(t, rate.Limit(1000), limiter.Limit())
+	assert.Equal(t, 1000, limiter.Burst())
+
+	// only idle clients with full buckets are forgotten
+	ls.Evict(0)
+	assert.Contains(t, ls.buckets, "b")
+	assert.NotContains(t, ls.buckets, "c")
+}
+
+func TestLimitRate(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.APITokens = "secret, other"
+	cfg.rateDownloads = rateSpec{Limit: rate.Limit(1.0 / 60), Burst: 1}
+	setConfig(cfg)
+	handler := limitRate(newLimiterSet(), func(cfg Config) rateSpec { return cfg.rateDownloads })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name           string
+		remote         string
+		auth           string
+		want           int
+		wantRetryAfter string
+	}{
+		{"first", "1.2.3.4:1000", "", http.StatusOK, ""},
+		{"limited", "1.2.3.4:1000", "", http.StatusTooManyRequests, "60"},
+		{"other port", "1.2.3.4:2000", "", http.StatusTooManyRequests, "60"},
+		{"other client", "5.6.7.8:1000", "", http.StatusOK, ""},
+		{"token", "1.2.3.4:1000", "Bearer secret", http.StatusOK, ""},
+		{"token limited", "5.6.7.8:1000", "Bearer secret", http.StatusTooManyRequests, "60"},
+		{"unknown token", "1.2.3.4:1000", "Bearer nonsense", http.StatusTooManyRequests, "60"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/123/a.txt", nil)
+		r.RemoteAddr = tt.remote
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, tt.want, w.Code, tt.name)
+		assert.Equal(t, tt.wantRetryAfter, w.Header().Get("Retry-After"), tt.name)
+	}
+}
+
+func TestLimitNotFound(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.rateLookups = rateSpec{Limit: rate.Limit(1.0 / 60), Burst: 2}
+	setConfig(cfg)
+	old := lookupLimiters
+	t.Cleanup(func() { lookupLimiters = old })
+	lookupLimiters = newLimiterSet()
+	handler := limitNotFound(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/found" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	// only lookups of IDs that do not exist count
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/found", http.StatusOK},
+		{"/found", http.StatusOK},
+		{"/missing", http.StatusNotFound},
+		{"/found", http.StatusOK},
+		{"/missing", http.StatusNotFound},
+		{"/found", http.StatusTooManyRequests},
+		{"/missing", http.StatusTooManyRequests},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		assert.Equal(t, tt.want, w.Code, tt.path)
+	}
+}
+
+func TestLimitConcurrentUploads(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.MaxConcurrentUploads = 1
+	setConfig(cfg)
+	inside := make(chan struct{})
+	release := make(chan struct{})
+	handler := limitConcurrentUploads(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inside <- struct{}{}
+		<-release
+	}))
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("PUT", "/a.txt", nil))
+		done <- w.Code
+	}()
+	<-inside
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/b.txt", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	go func() { <-inside }()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/b.txt", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestStartUploadSession(t *testing.T) {
+	resetUploads()
+	t.Cleanup(resetUploads)
+	uploadLimiters = newLimiterSet()
+	limits := func(concurrent int, rate string) Config {
+		cfg := Config{MaxConcurrentUploads: concurrent, RateUploads: rate}
+		finalizeConfig(&cfg)
+		return cfg
+	}
+	tests := []struct {
+		uuid string
+		key  string
+		cfg  Config
+		want bool
+	}{
+		{"u1", "ip:1.2.3.4", limits(2, ""), true},
+		{"u1", "ip:1.2.3.4", limits(2, ""), true},
+		{"u2", "ip:1.2.3.4", limits(2, ""), true},
+		{"u3", "ip:1.2.3.4", limits(2, ""), false},
+		{"u3", "ip:5.6.7.8", limits(2, ""), true},
+		{"u4", "ip:1.2.3.4", limits(0, ""), true},
+		// the rate counts uploads, not their chunks
+		{"u5", "ip:9.9.9.9", limits(0, "1/h"), true},
+		{"u5", "ip:9.9.9.9", limits(0, "1/h"), true},
+		{"u6", "ip:9.9.9.9", limits(0, "1/h"), false},
+	}
+	for _, tt := range tests {
+		ok, _ := startUploadSession(tt.uuid, tt.key, tt.cfg)
+		assert.Equal(t, tt.want, ok, tt.uuid+" "+tt.key)
+	}
+	// abandoned uploads stop counting
+	uploadsStarted["u1"] = time.Now().Add(-2 * time.Hour)
+	ok, _ := startUploadSession("u7", "ip:1.2.3.4", limits(3, ""))
+	assert.True(t, ok)
+}
+
+// countingBody counts how much of the data of an upload is read
+type countingBody struct {
+	io.Reader
+	n int
+}
+
+func (b *countingBody) Read(p []byte) (n int, err error) {
+	n, err = b.Reader.Read(p)
+	b.n += n
+	return
+}
+
+// chunkRequest returns a Dropzone request with a chunk of an upload, and
+// the reader of the data of the chunk
+func chunkRequest(uuid string, fields map[string]string, data []byte) (*http.Request, *countingBody) {
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	for _, k := range []string{"dzuuid", "dzchunkindex", "dztotalchunkcount", "dzchunksize", "strip"} {
+		if v, ok := fields[k]; ok {
+			mw.WriteField(k, v)
+		}
+	}
+	if uuid != "" {
+		mw.WriteField("dzuuid", uuid)
+	}
+	mw.CreateFormFile("file", "a.txt")
+	body := &countingBody{Reader: bytes.NewReader(data)}
+	tail := "\r\n--" + mw.Boundary() + "--\r\n"
+	r := httptest.NewRequest("POST", "/", io.MultiReader(&head, body, strings.NewReader(tail)))
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.RemoteAddr = "192.0.2.1:1234"
+	return r, body
+}
+
+func TestHandlePostLimits(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.RateUploads = "1/h"
+	finalizeConfig(&cfg)
+	setConfig(cfg)
+	resetUploads()
+	t.Cleanup(resetUploads)
+	uploadsHash = make(map[string]string)
+	uploadLimiters = newLimiterSet()
+
+	rt := newRouter()
+	data := bytes.Repeat([]byte("a"), 100000)
+	single := map[string]string{"dzchunkindex": "0", "dztotalchunkcount": "1", "dzchunksize": "200000"}
+	tests := []struct {
+		name     string
+		uuid     string
+		fields   map[string]string
+		wantCode int
+		wantRead bool
+	}{
+		{"first upload", "u1", single, http.StatusCreated, true},
+		{"over the rate", "u2", single, http.StatusTooManyRequests, false},
+		{"over the rate as the first chunk again", "u3", single, http.StatusTooManyRequests, false},
+		{"no upload ID", "", single, http.StatusBadRequest, false},
+		{"chunk out of range", "u4", map[string]string{"dzchunkindex": "5", "dztotalchunkcount": "1", "dzchunksize": "200000"}, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, body := chunkRequest(tt.uuid, tt.fields, data)
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.Equal(t, tt.wantRead, body.n == len(data), "read %d bytes", body.n)
+		})
+	}
+}
+
+func TestHandlePostChunkSize(t *testing.T) {
+	useTestConfig(t)
+	resetUploads()
+	t.Cleanup(resetUploads)
+	uploadsHash = make(map[string]string)
+	uploadLimiters = newLimiterSet()
+	r, _ := chunkRequest("u1", map[string]string{"dzchunkindex": "0", "dztotalchunkcount": "2", "dzchunksize": "1000"}, make([]byte, 2000))
+	w := httptest.NewRecorder()
+	assert.NotNil(t, handleUpload(w, r))
+	files, _ := filepath.Glob(filepath.Join(getConfig().ContentDirectory, "sharetemp*"))
+	assert.Empty(t, files)
+}
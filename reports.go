@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/schollz/logger"
+)
+
+// reportsFile is where the moderation queue is saved, in the data directory
+const reportsFile = "sharereports.json"
+
+// reportsMaxAge is how long resolved reports are kept
+const reportsMaxAge = 30 * 24 * time.Hour
+
+// reportsMaxResolved is how many resolved reports are kept, the oldest
+// resolved are forgotten first
+const reportsMaxResolved = 1000
+
+// reportDetailsMaxBytes is how much of the details of a report is kept
+const reportDetailsMaxBytes = 2000
+
+// reportReasons are the reasons that a file can be reported for
+var reportReasons = map[string]string{
+	"illegal":   "Illegal content",
+	"malware":   "Malware or phishing",
+	"copyright": "Copyright infringement",
+	"abuse":     "Harassment or abuse",
+	"other":     "Other",
+}
+
+// report resolutions
+const (
+	reportDismissed = "dismissed"
+	reportDeleted   = "deleted"
+	reportBlocked   = "blocked"
+)
+
+// report is a report of a file by a visitor
+type report struct {
+	ID         string
+	ShareID    string
+	Name       string
+	Hash       string
+	Reason     string
+	Details    string
+	Reporter   string
+	Reported   time.Time
+	Resolution string
+	Resolved   time.Time
+}
+
+// ReasonHuman is the description of the reason of the report
+func (rep report) ReasonHuman() string {
+	if reason, ok := reportReasons[rep.Reason]; ok {
+		return reason
+	}
+	return rep.Reason
+}
+
+// reportQueue is the moderation queue of reports, which is saved to disk
+// every time it changes.
+type reportQueue struct {
+	sync.RWMutex
+	reports []report
+}
+
+// reports is the moderation queue
+var reports = &reportQueue{}
+
+// loadReports loads the moderation queue from the data directory
+func loadReports() (err error) {
+	b, err := os.ReadFile(path.Join(getConfig().ContentDirectory, reportsFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	var list []report
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return
+	}
+	reports.Lock()
+	reports.reports = list
+	reports.Unlock()
+	log.Debugf("loaded %d reports", len(list))
+	return
+}
+
+// save writes the moderation queue to the data directory and forgets old
+// resolved reports, the lock must be held
+func (rq *reportQueue) save() (err error) {
+	var resolved []time.Time
+	for _, rep := range rq.reports {
+		if rep.Resolution != "" {
+			resolved = append(resolved, rep.Resolved)
+		}
+	}
+	oldest := time.Now().Add(-reportsMaxAge)
+	if len(resolved) > reportsMaxResolved {
+		sort.Slice(resolved, func(i, j int) bool { return resolved[i].After(resolved[j]) })
+		if t := resolved[reportsMaxResolved-1]; t.After(oldest) {
+			oldest = t
+		}
+	}
+	kept := rq.reports[:0]
+	for _, rep := range rq.reports {
+		if rep.Resolution == "" || !rep.Resolved.Before(oldest) {
+			kept = append(kept, rep)
+		}
+	}
+	rq.reports = kept
+
+	b, err := json.MarshalIndent(rq.reports, "", " ")
+	if err != nil {
+		return
+	}
+	fname := path.Join(getConfig().ContentDirectory, reportsFile)
+	err = os.WriteFile(fname+".tmp", b, 0644)
+	if err != nil {
+		return
+	}
+	return os.Rename(fname+".tmp", fname)
+}
+
+// Add adds a report to the queue, unless the reporter already has an open
+// report for the file
+func (rq *reportQueue) Add(rep report) (added report, err error) {
+	rq.Lock()
+	defer rq.Unlock()
+	for _, existing := range rq.reports {
+		if existing.Resolution == "" && existing.ShareID == rep.ShareID && existing.Hash == rep.Hash && existing.Reporter == rep.Reporter {
+			return existing, nil
+		}
+	}
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+	rep.ID = hex.EncodeToString(id)
+	rep.Reported = time.Now()
+	rq.reports = append(rq.reports, rep)
+	return rep, rq.save()
+}
+
+// Get returns a report
+func (rq *reportQueue) Get(id string) (rep report, ok bool) {
+	rq.RLock()
+	defer rq.RUnlock()
+	for _, rep = range rq.reports {
+		if rep.ID == id {
+			return rep, true
+		}
+	}
+	return report{}, false
+}
+
+// Open returns the reports that are not resolved yet, oldest first
+func (rq *reportQueue) Open() (open []report) {
+	rq.RLock()
+	defer rq.RUnlock()
+	for _, rep := range rq.reports {
+		if rep.Resolution == "" {
+			open = append(open, rep)
+		}
+	}
+	return
+}
+
+// Resolve resolves the open reports that match
+func (rq *reportQueue) Resolve(resolution string, match func(rep report) bool) error {
+	rq.Lock()
+	defer rq.Unlock()
+	changed := false
+	for i, rep := range rq.reports {
+		if rep.Resolution == "" && match(rep) {
+			rq.reports[i].Resolution = resolution
+			rq.reports[i].Resolved = time.Now()
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return rq.save()
+}
+
+// handleReport handles POST /<id>/report, which adds a report of the file
+// to the moderation queue
+func handleReport(w http.ResponseWriter, r *http.Request) (err error) {
+	p, err := loadRequestPage(r)
+	if err != nil {
+		return
+	}
+	reason := r.FormValue("reason")
+	if _, ok := reportReasons[reason]; !ok {
+		return fmt.Errorf("Please choose a reason for the report.")
+	}
+	details := truncateUTF8(strings.TrimSpace(r.FormValue("details")), reportDetailsMaxBytes)
+	rep, err := reports.Add(report{
+		ShareID:  p.ID,
+		Name:     p.Name,
+		Hash:     p.Hash,
+		Reason:   reason,
+		Details:  details,
+		Reporter: clientIP(r),
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	auditRequest(r, auditEventReport, p)
+	log.Infof("%s reported %s (%s)", rep.Reporter, p.ID, reason)
+
+	msg := "Thank you, the file was reported and will be reviewed."
+	if negotiateClient(r) != clientHTML {
+		jsonResponse(w, http.StatusCreated, map[string]string{"message": msg, "report": rep.ID})
+		return
+	}
+	p.Error = msg
+	return p.handleShowDataInBrowser(w, r)
+}
+
+// truncateUTF8 shortens a string to at most max bytes without cutting a
+// character in half
+func truncateUTF8(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// removeCopies deletes all uploads of the file with a hash
+func removeCopies(r *http.Request, hash string, reason string) (removed []string) {
+	for _, p := range pages.List() {
+		if p.Hash != hash {
+			continue
+		}
+		if err := deletePage(r, p.ID, reason); err != nil {
+			log.Errorf("could not remove %s: %s", p.ID, err.Error())
+			continue
+		}
+		removed = append(removed, p.ID)
+	}
+	return
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello", 3, "hel"},
+		{"héllo", 2, "h"},
+		{"héllo", 3, "hé"},
+		{"日本語", 4, "日"},
+		{"日本語", 2, ""},
+		{"👍👍", 7, "👍"},
+	}
+	for _, tt := range tests {
+		got := truncateUTF8(tt.s, tt.max)
+		assert.Equal(t, tt.want, got, tt.s)
+		assert.True(t, utf8.ValidString(got), tt.s)
+	}
+}
+
+func TestReportQueue(t *testing.T) {
+	useTestConfig(t)
+	old := reports
+	t.Cleanup(func() { reports = old })
+	reports = &reportQueue{}
+
+	first, err := reports.Add(report{ShareID: "abc", Hash: "h1", Reason: "malware", Reporter: "1.2.3.4"})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, first.ID)
+	// the same reporter can not report the same file twice
+	again, err := reports.Add(report{ShareID: "abc", Hash: "h1", Reason: "other", Reporter: "1.2.3.4"})
+	assert.Nil(t, err)
+	assert.Equal(t, first.ID, again.ID)
+	_, err = reports.Add(report{ShareID: "abc", Hash: "h1", Reason: "other", Reporter: "5.6.7.8"})
+	assert.Nil(t, err)
+	_, err = reports.Add(report{ShareID: "def", Hash: "h2", Reason: "other", Reporter: "5.6.7.8"})
+	assert.Nil(t, err)
+	assert.Len(t, reports.Open(), 3)
+
+	assert.Nil(t, reports.Resolve(reportDeleted, func(rep report) bool { return rep.ShareID == "abc" }))
+	assert.Len(t, reports.Open(), 1)
+	rep, ok := reports.Get(first.ID)
+	assert.True(t, ok)
+	assert.Equal(t, reportDeleted, rep.Resolution)
+	assert.Equal(t, "Malware or phishing", rep.ReasonHuman())
+
+	// the queue survives a restart
+	reports = &reportQueue{}
+	assert.Nil(t, loadReports())
+	assert.Len(t, reports.Open(), 1)
+	_, ok = reports.Get(first.ID)
+	assert.True(t, ok)
+
+	// old resolved reports are forgotten when the queue is saved
+	reports.Lock()
+	reports.reports[0].Resolved = time.Now().Add(-2 * reportsMaxAge)
+	reports.Unlock()
+	_, err = reports.Add(report{ShareID: "ghi", Hash: "h3", Reason: "other", Reporter: "5.6.7.8"})
+	assert.Nil(t, err)
+	_, ok = reports.Get(first.ID)
+	assert.False(t, ok)
+	assert.Len(t, reports.Open(), 2)
+}
+
+func TestReportQueuePrunesResolved(t *testing.T) {
+	useTestConfig(t)
+	now := time.Now()
+	rq := &reportQueue{}
+	rq.reports = append(rq.reports, report{ID: "open", Reported: now.Add(-2 * reportsMaxAge)})
+	rq.reports = append(rq.reports, report{ID: "expired", Resolution: reportDismissed, Resolved: now.Add(-2 * reportsMaxAge)})
+	for i := 0; i < reportsMaxResolved+5; i++ {
+		rq.reports = append(rq.reports, report{Resolution: reportDismissed, Resolved: now.Add(-time.Duration(i) * time.Minute)})
+	}
+	rq.Lock()
+	assert.Nil(t, rq.save())
+	rq.Unlock()
+
+	assert.Len(t, rq.reports, reportsMaxResolved+1)
+	assert.Len(t, rq.Open(), 1)
+	_, ok := rq.Get("expired")
+	assert.False(t, ok)
+	for _, rep := range rq.reports {
+		// the most recently resolved are kept
+		assert.True(t, rep.Resolution == "" || now.Sub(rep.Resolved) < reportsMaxResolved*time.Minute)
+	}
+}
+
+func TestReportRateLimit(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.RateReports = "2/h"
+	finalizeConfig(&cfg)
+	setConfig(cfg)
+	old := reports
+	t.Cleanup(func() { reports = old })
+	reports = &reportQueue{}
+	p := writeTestUpload(t, "abc", "a.txt", []byte("data"))
+	assert.Nil(t, savePageInfo(p))
+
+	rt := newRouter()
+	var codes []int
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("POST", "/abc/report", strings.NewReader("reason=malware"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+	}
+	assert.Less(t, codes[0], 400)
+	assert.Less(t, codes[1], 400)
+	assert.Equal(t, http.StatusTooManyRequests, codes[2])
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// routeHandler handles the request for a route. A returned error is shown
+// to the client, as a page for browsers and as JSON otherwise.
+type routeHandler func(w http.ResponseWriter, r *http.Request) error
+
+// middleware wraps a handler, e.g. for logging, authentication or rate
+// limiting.
+type middleware func(http.Handler) http.Handler
+
+// route is a named route for a method and a path pattern. Patterns are
+// made of literal segments, "{name}" segments that match any one segment
+// and a final "{name...}" segment that matches the rest of the path.
+type route struct {
+	Name       string
+	Method     string
+	Pattern    string
+	Handler    routeHandler
+	Middleware []middleware
+
+	segments []string
+	handler  http.Handler
+}
+
+// router dispatches requests to the first route that matches the path and
+// the method. GET routes also answer HEAD requests, OPTIONS requests are
+// answered with the allowed methods and paths that only match routes for
+// other methods get a 405.
+type router struct {
+	routes     []*route
+	middleware []middleware
+	handler    http.Handler
+}
+
+type contextKey string
+
+const (
+	routeKey        contextKey = "route"
+	routeParamsKey  contextKey = "params"
+	routeAllowedKey contextKey = "allowed"
+	requestInfoKey  contextKey = "info"
+)
+
+// Use adds middleware that runs for every request, in the order added.
+// It must be called before the router starts serving.
+func (rt *router) Use(mw ...middleware) {
+	rt.middleware = append(rt.middleware, mw...)
+	var h http.Handler = http.HandlerFunc(rt.dispatch)
+	for i := len(rt.middleware) - 1; i >= 0; i-- {
+		h = rt.middleware[i](h)
+	}
+	rt.handler = h
+}
+
+// Handle adds a route, with optional middleware that only runs for it.
+func (rt *router) Handle(name, method, pattern string, h routeHandler, mw ...middleware) {
+	ro := &route{
+		Name:       name,
+		Method:     method,
+		Pattern:    pattern,
+		Handler:    h,
+		Middleware: mw,
+		segments:   strings.Split(strings.Trim(pattern, "/"), "/"),
+	}
+	ro.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := ro.Handler(w, r); err != nil {
+			code := http.StatusBadRequest
+			if _, ok := err.(notFoundError); ok {
+				code = http.StatusNotFound
+			}
+			handleError(w, r, code, err)
+		}
+	})
+	for i := len(mw) - 1; i >= 0; i-- {
+		ro.handler = mw[i](ro.handler)
+	}
+	rt.routes = append(rt.routes, ro)
+}
+
+// match returns the parameters if the path matches the route pattern.
+func (ro *route) match(urlPath string) (params map[string]string, ok bool) {
+	segments := strings.Split(strings.Trim(urlPath, "/"), "/")
+	params = make(map[string]string)
+	for i, pattern := range ro.segments {
+		if strings.HasPrefix(pattern, "{") && strings.HasSuffix(pattern, "...}") {
+			if i >= len(segments) || segments[i] == "" {
+				return nil, false
+			}
+			params[strings.TrimSuffix(pattern[1:], "...}")] = strings.Join(segments[i:], "/")
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		if strings.HasPrefix(pattern, "{") && strings.HasSuffix(pattern, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[pattern[1:len(pattern)-1]] = segments[i]
+		} else if pattern != segments[i] {
+			return nil, false
+		}
+	}
+	if len(segments) != len(ro.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// allows returns whether the route handles the method
+func (ro *route) allows(method string) bool {
+	return ro.Method == method || (ro.Method == http.MethodGet && method == http.MethodHead)
+}
+
+// ServeHTTP finds the route for the request, then runs the middleware and
+// the route.
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stripBasePath(r)
+	ro, params, allowed := rt.find(r)
+	ctx := context.WithValue(r.Context(), routeKey, ro)
+	ctx = context.WithValue(ctx, routeParamsKey, params)
+	ctx = context.WithValue(ctx, routeAllowedKey, allowed)
+	ctx = context.WithValue(ctx, requestInfoKey, &requestInfo{})
+	r = r.WithContext(ctx)
+	if rt.handler == nil {
+		rt.dispatch(w, r)
+		return
+	}
+	rt.handler.ServeHTTP(w, r)
+}
+
+// find returns the first route that matches the path and the method of the
+// request, or the methods that are allowed for the path otherwise.
+func (rt *router) find(r *http.Request) (found *route, params map[string]string, allowed []string) {
+	for _, ro := range rt.routes {
+		var ok bool
+		params, ok = ro.match(r.URL.Path)
+		if !ok {
+			continue
+		}
+		if ro.allows(r.Method) {
+			return ro, params, nil
+		}
+		allowed = append(allowed, ro.Method)
+		if ro.Method == http.MethodGet {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	return nil, nil, allowed
+}
+
+// dispatch runs the route of the request, or answers with 404, 405 or the
+// allowed methods for OPTIONS.
+func (rt *router) dispatch(w http.ResponseWriter, r *http.Request) {
+	if ro, _ := r.Context().Value(routeKey).(*route); ro != nil {
+		ro.handler.ServeHTTP(w, r)
+		return
+	}
+
+	allowed, _ := r.Context().Value(routeAllowedKey).([]string)
+	if len(allowed) == 0 {
+		handleError(w, r, http.StatusNotFound, errNotFound)
+		return
+	}
+	allow := uniqueSorted(append(allowed, http.MethodOptions))
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	if r.Method == http.MethodOptions {
+		// CORS preflight
+		if w.Header().Get("Access-Control-Allow-Origin") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(allow, ", "))
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", "600")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	jsonResponse(w, http.StatusMethodNotAllowed, map[string]string{"message": "Method not allowed."})
+}
+
+// uniqueSorted returns the sorted unique strings
+func uniqueSorted(s []string) (unique []string) {
+	sort.Strings(s)
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			unique = append(unique, v)
+		}
+	}
+	return
+}
+
+// routeName returns the name of the route that handles the request, or an
+// empty string if no route matched.
+func routeName(r *http.Request) string {
+	if ro, _ := r.Context().Value(routeKey).(*route); ro != nil {
+		return ro.Name
+	}
+	return ""
+}
+
+// routeParam returns a parameter from the route pattern
+func routeParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(routeParamsKey).(map[string]string)
+	return params[name]
+}
+
+// handleError shows an error to the client: the home page with the error
+// for browsers, otherwise a JSON response.
+func handleError(w http.ResponseWriter, r *http.Request, code int, err error) {
+	if negotiateClient(r) != clientHTML {
+		jsonResponse(w, code, map[string]string{"message": err.Error()})
+		return
+	}
+	p := newRequestPage(r)
+	p.Error = err.Error()
+	if code != http.StatusBadRequest {
+		w.WriteHeader(code)
+	}
+	p.handleGetHome(w, r)
+}
+
+// responseRecorder records the status code and the number of bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.Status == 0 {
+		rec.Status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (n int, err error) {
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+	}
+	n, err = rec.ResponseWriter.Write(b)
+	rec.Bytes += int64(n)
+	return
+}
+
+// Flush lets streaming responses through the recorder
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logRequests is the middleware that logs every request, also to the
+// access log when it is enabled.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now().UTC()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		log.Infof("%v %v %v %d %s", clientIP(r), r.Method, r.URL.Path, rec.Status, time.Since(t))
+		accessLog.Log(accessLogEntry{
+			Time:       t,
+			ClientIP:   clientIP(r),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Route:      routeName(r),
+			Status:     rec.Status,
+			Bytes:      rec.Bytes,
+			DurationMS: float64(time.Since(t).Microseconds()) / 1000,
+			UserAgent:  r.UserAgent(),
+			Referer:    r.Referer(),
+			ShareID:    requestShareID(r),
+		})
+	})
+}
+
+// allowCORS is the middleware that adds the CORS headers for the allowed
+// origins.
+func allowCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			for _, allowed := range strings.Split(getConfig().CORSOrigins, ",") {
+				allowed = strings.TrimSpace(allowed)
+				if allowed == "*" || (allowed != "" && allowed == origin) {
+					w.Header().Set("Access-Control-Allow-Origin", allowed)
+					w.Header().Add("Vary", "Origin")
+					break
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
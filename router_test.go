@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    map[string]string
+		ok      bool
+	}{
+		{"/", "/", map[string]string{}, true},
+		{"/", "/about", nil, false},
+		{"/about", "/about/", map[string]string{}, true},
+		{"/{id}", "/123", map[string]string{"id": "123"}, true},
+		{"/{id}", "/123/a.txt", nil, false},
+		{"/{id}/{name}", "/123/a.txt", map[string]string{"id": "123", "name": "a.txt"}, true},
+		{"/{id}/{name}", "/123", nil, false},
+		{"/stream/{id}/{name}", "/raw/123/a.txt", nil, false},
+		{"/static/{file...}", "/static/css/style.css", map[string]string{"file": "css/style.css"}, true},
+		{"/static/{file...}", "/static/", nil, false},
+		{"/static/{file...}", "/static", nil, false},
+	}
+	for _, tt := range tests {
+		rt := &router{}
+		rt.Handle("test", http.MethodGet, tt.pattern, nil)
+		params, ok := rt.routes[0].match(tt.path)
+		assert.Equal(t, tt.ok, ok, tt.pattern+" "+tt.path)
+		assert.Equal(t, tt.want, params, tt.pattern+" "+tt.path)
+	}
+}
+
+func TestRouterDispatch(t *testing.T) {
+	rt := &router{}
+	handler := func(name string) routeHandler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			w.Write([]byte(name + " " + routeParam(r, "id")))
+			return nil
+		}
+	}
+	rt.Handle("about", http.MethodGet, "/about", handler("about"))
+	rt.Handle("get", http.MethodGet, "/{id}", handler("get"))
+	rt.Handle("delete", http.MethodDelete, "/{id}", handler("delete"))
+	rt.Handle("fail", http.MethodGet, "/fail/{id}", func(w http.ResponseWriter, r *http.Request) error {
+		if routeParam(r, "id") == "missing" {
+			return errNotFound
+		}
+		return errors.New("failed")
+	})
+
+	tests := []struct {
+		method    string
+		path      string
+		wantCode  int
+		wantBody  string
+		wantAllow string
+	}{
+		{http.MethodGet, "/about", http.StatusOK, "about ", ""},
+		{http.MethodGet, "/123", http.StatusOK, "get 123", ""},
+		{http.MethodHead, "/123", http.StatusOK, "get 123", ""},
+		{http.MethodDelete, "/123", http.StatusOK, "delete 123", ""},
+		{http.MethodPost, "/123", http.StatusMethodNotAllowed, "", "DELETE, GET, HEAD, OPTIONS"},
+		{http.MethodOptions, "/123", http.StatusNoContent, "", "DELETE, GET, HEAD, OPTIONS"},
+		{http.MethodGet, "/fail/missing", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/fail/other", http.StatusBadRequest, "", ""},
+		{http.MethodGet, "/a/b/c", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		name := tt.method + " " + tt.path
+		assert.Equal(t, tt.wantCode, w.Code, name)
+		assert.Equal(t, tt.wantAllow, w.Header().Get("Allow"), name)
+		if tt.wantBody != "" {
+			assert.Equal(t, tt.wantBody, w.Body.String(), name)
+		}
+	}
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	var order []string
+	mark := func(name string) middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	rt := &router{}
+	rt.Use(mark("global1"), mark("global2"))
+	rt.Handle("home", http.MethodGet, "/", func(w http.ResponseWriter, r *http.Request) error {
+		order = append(order, routeName(r))
+		return nil
+	}, mark("route"))
+	rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, []string{"global1", "global2", "route", "home"}, order)
+}
+
+func TestHeadReadsNoData(t *testing.T) {
+	useTestConfig(t)
+	data := bytes.Repeat([]byte("data "), 1000)
+	p := writeTestUpload(t, "abc", "a.txt", data)
+	p.Hash = "abc"
+	assert.Nil(t, savePageInfo(p))
+	info, err := os.Stat(p.NameOnDisk)
+	assert.Nil(t, err)
+
+	rt := newRouter()
+	downloads := func() float64 {
+		return testutil.ToFloat64(metricDownloadBytes.WithLabelValues("raw"))
+	}
+	before := downloads()
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/1/abc/a.txt", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 0, w.Body.Len())
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, strconv.FormatInt(info.Size(), 10), w.Header().Get("Content-Length"))
+	assert.Equal(t, before, downloads())
+
+	w = httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/1/abc/a.txt", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int(info.Size()), w.Body.Len())
+	assert.Equal(t, before+float64(info.Size()), downloads())
+}
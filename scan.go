@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// scan statuses of uploads. Uploads from before scanning was enabled have
+// no status and are available.
+const (
+	scanPending  = "pending"
+	scanClean    = "clean"
+	scanInfected = "infected"
+	scanError    = "error"
+)
+
+// scanResult is the verdict of a scanner
+type scanResult struct {
+	Infected  bool
+	Signature string
+}
+
+// scanner scans the data of an upload for malware
+type scanner interface {
+	Scan(ctx context.Context, r io.Reader) (scanResult, error)
+}
+
+// newScanner returns the scanner that is configured, or nil if scanning is
+// disabled
+func newScanner(cfg Config) scanner {
+	if cfg.ScanClamd != "" {
+		network, address := "tcp", cfg.ScanClamd
+		if strings.HasPrefix(address, "unix:") || strings.HasPrefix(address, "/") {
+			network, address = "unix", strings.TrimPrefix(address, "unix:")
+		} else {
+			address = strings.TrimPrefix(address, "tcp:")
+		}
+		return &clamdScanner{Network: network, Address: address}
+	}
+	if cfg.ScanCommand != "" {
+		return &commandScanner{Command: strings.Fields(cfg.ScanCommand)}
+	}
+	return nil
+}
+
+// clamdScanner streams the data to a ClamAV daemon with the INSTREAM
+// command
+type clamdScanner struct {
+	Network string
+	Address string
+}
+
+// clamdChunkSize is the size of the chunks sent to clamd
+const clamdChunkSize = 64 * 1024
+
+func (cs *clamdScanner) Scan(ctx context.Context, r io.Reader) (result scanResult, err error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, cs.Network, cs.Address)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, errRead := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err = conn.Write(buf[:4+n]); err != nil {
+				// clamd closes the connection when the stream is too big,
+				// the reply says why
+				break
+			}
+		}
+		if errRead == io.EOF || errRead == io.ErrUnexpectedEOF {
+			break
+		} else if errRead != nil {
+			return result, errRead
+		}
+	}
+	if err == nil {
+		_, err = conn.Write([]byte{0, 0, 0, 0})
+	}
+
+	reply, errReply := bufio.NewReader(conn).ReadString(0)
+	if errReply != nil && reply == "" {
+		if err == nil {
+			err = errReply
+		}
+		return
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply parses a reply like "stream: OK" or
+// "stream: Eicar-Signature FOUND"
+func parseClamdReply(reply string) (result scanResult, err error) {
+	reply = strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case reply == "OK":
+		return
+	case strings.HasSuffix(reply, " FOUND"):
+		result.Infected = true
+		result.Signature = strings.TrimSuffix(reply, " FOUND")
+		return
+	}
+	err = fmt.Errorf("clamd: %s", reply)
+	return
+}
+
+// commandScanner pipes the data to the stdin of a command, which exits with
+// 0 for clean data and 1 for infected data (like clamscan and clamdscan).
+// What the command prints is used as the signature.
+type commandScanner struct {
+	Command []string
+}
+
+func (cs *commandScanner) Scan(ctx context.Context, r io.Reader) (result scanResult, err error) {
+	cmd := exec.CommandContext(ctx, cs.Command[0], cs.Command[1:]...)
+	cmd.Stdin = r
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		result.Infected = true
+		result.Signature = truncateUTF8(strings.TrimSpace(out.String()), 200)
+		return result, nil
+	} else if err != nil {
+		err = fmt.Errorf("%s: %s %s", cs.Command[0], err.Error(), strings.TrimSpace(out.String()))
+	}
+	return
+}
+
+// scans keeps track of the uploads being scanned, so that each is only
+// scanned once at a time, and limits how many are scanned at once
+var scans = struct {
+	sync.Mutex
+	running map[string]bool
+	slots   chan struct{}
+}{running: make(map[string]bool), slots: make(chan struct{}, 2)}
+
+// startScan scans an upload in the background
+func startScan(p *Page) {
+	scans.Lock()
+	if scans.running[p.ID] {
+		scans.Unlock()
+		return
+	}
+	scans.running[p.ID] = true
+	scans.Unlock()
+
+	go func() {
+		defer func() {
+			scans.Lock()
+			delete(scans.running, p.ID)
+			scans.Unlock()
+		}()
+		scans.slots <- struct{}{}
+		defer func() { <-scans.slots }()
+		scanUpload(p)
+	}()
+}
+
+// scanUpload scans an upload and makes it available when it is clean or
+// quarantines it when it is infected
+func scanUpload(p *Page) {
+	cfg := getConfig()
+	sc := newScanner(cfg)
+	if sc == nil {
+		log.Warnf("scanning disabled, %s stays unscanned", p.ID)
+		return
+	}
+
+	start := time.Now()
+	result, err := func() (result scanResult, err error) {
+		f, err := os.Open(p.NameOnDisk)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return
+		}
+		defer gr.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ScanTimeoutSeconds)*time.Second)
+		defer cancel()
+		return sc.Scan(ctx, gr)
+	}()
+
+	// the upload may have been deleted in the meantime
+	current, errInfo := loadPageInfo(p.ID)
+	if errInfo != nil || current.Hash != p.Hash {
+		return
+	}
+	p = current
+	p.ScanSignature = ""
+	switch {
+	case err != nil:
+		log.Errorf("could not scan %s: %s", p.ID, err.Error())
+		p.ScanStatus = scanError
+	case result.Infected:
+		log.Infof("%s is infected: %s", p.ID, result.Signature)
+		p.ScanStatus = scanInfected
+		p.ScanSignature = result.Signature
+	default:
+		log.Debugf("%s is clean (%s)", p.ID, time.Since(start))
+		p.ScanStatus = scanClean
+	}
+	observeScan(p.ScanStatus, start)
+
+	if p.ScanStatus == scanInfected {
+		// the upload stays pending until it is moved, so that it can't be
+		// downloaded in the meantime
+		err = quarantine(p)
+		if err != nil {
+			log.Errorf("could not quarantine %s: %s", p.ID, err.Error())
+			// it is refused where it is
+			savePageInfo(p)
+		}
+		return
+	}
+	err = savePageInfo(p)
+	if err != nil {
+		return
+	}
+	pages.Put(p)
+	startThumbnail(p)
+}
+
+// quarantine moves an upload out of the data directory, with its
+// information
+func quarantine(p *Page) (err error) {
+	cfg := getConfig()
+	err = os.MkdirAll(cfg.QuarantineDirectory, 0700)
+	if err != nil {
+		return
+	}
+	dst := path.Join(cfg.QuarantineDirectory, fmt.Sprintf("%s-%d", p.ID, time.Now().Unix()))
+	err = moveUpload(p.ID, dst)
+	if err != nil {
+		return
+	}
+	if errInfo := writePageInfo(path.Join(dst, p.ID+".json.gz"), p); errInfo != nil {
+		log.Errorf("could not save the information of quarantined %s: %s", p.ID, errInfo.Error())
+	}
+	pages.Delete(p.ID)
+	observeDeletion(deletionQuarantined)
+	auditCleanup(auditEventQuarantine, p)
+	log.Infof("quarantined %s to %s", p.ID, dst)
+	return
+}
+
+// copyDir copies the files of a directory
+func copyDir(src, dst string) (err error) {
+	err = os.MkdirAll(dst, 0700)
+	if err != nil {
+		return
+	}
+	files, err := os.ReadDir(src)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		err = copyFile(path.Join(src, f.Name()), path.Join(dst, f.Name()))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// copyFile copies a file
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(out, in)
+	if errClose := out.Close(); err == nil {
+		err = errClose
+	}
+	return
+}
+
+// Scanning returns whether the upload is waiting to be scanned
+func (p *Page) Scanning() bool {
+	return p.ScanStatus == scanPending
+}
+
+// ScanFailed returns whether the upload could not be scanned
+func (p *Page) ScanFailed() bool {
+	return p.ScanStatus == scanError
+}
+
+// refuseUnscanned answers requests for the data of uploads that are not
+// scanned (yet). It returns whether the response is finished.
+func (p *Page) refuseUnscanned(w http.ResponseWriter, r *http.Request) bool {
+	switch p.ScanStatus {
+	case scanPending:
+		w.Header().Set("Retry-After", "5")
+		jsonResponse(w, http.StatusServiceUnavailable, map[string]string{"message": "The file is being scanned, please try again soon."})
+		return true
+	case scanError:
+		jsonResponse(w, http.StatusServiceUnavailable, map[string]string{"message": "The file could not be scanned."})
+		return true
+	case scanInfected:
+		jsonResponse(w, http.StatusGone, map[string]string{"message": "The file is infected."})
+		return true
+	}
+	return false
+}
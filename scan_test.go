@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewScanner(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want scanner
+	}{
+		{Config{}, nil},
+		{Config{ScanClamd: "localhost:3310"}, &clamdScanner{Network: "tcp", Address: "localhost:3310"}},
+		{Config{ScanClamd: "tcp:localhost:3310"}, &clamdScanner{Network: "tcp", Address: "localhost:3310"}},
+		{Config{ScanClamd: "unix:/run/clamd.sock"}, &clamdScanner{Network: "unix", Address: "/run/clamd.sock"}},
+		{Config{ScanClamd: "/run/clamd.sock", ScanCommand: "clamdscan -"}, &clamdScanner{Network: "unix", Address: "/run/clamd.sock"}},
+		{Config{ScanCommand: "clamdscan --no-summary -"}, &commandScanner{Command: []string{"clamdscan", "--no-summary", "-"}}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, newScanner(tt.cfg))
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    scanResult
+		wantErr bool
+	}{
+		{"stream: OK", scanResult{}, false},
+		{"stream: Eicar-Signature FOUND", scanResult{Infected: true, Signature: "Eicar-Signature"}, false},
+		{"INSTREAM size limit exceeded. ERROR", scanResult{}, true},
+	}
+	for _, tt := range tests {
+		result, err := parseClamdReply(tt.reply)
+		assert.Equal(t, tt.wantErr, err != nil, tt.reply)
+		assert.Equal(t, tt.want, result, tt.reply)
+	}
+}
+
+// fakeClamd answers INSTREAM requests like clamd, finding data that
+// contains "EICAR"
+func fakeClamd(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				if cmd, err := rd.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					return
+				}
+				var data strings.Builder
+				for {
+					var size uint32
+					if binary.Read(rd, binary.BigEndian, &size) != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					io.CopyN(&data, rd, int64(size))
+				}
+				if strings.Contains(data.String(), "EICAR") {
+					conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestScanners(t *testing.T) {
+	clamd := &clamdScanner{Network: "tcp", Address: fakeClamd(t)}
+	tests := []struct {
+		name    string
+		scanner scanner
+		data    string
+		want    scanResult
+		wantErr bool
+	}{
+		{"clamd clean", clamd, "hello", scanResult{}, false},
+		{"clamd infected", clamd, strings.Repeat("x", 2*clamdChunkSize) + "EICAR", scanResult{Infected: true, Signature: "Eicar-Signature"}, false},
+		{"clamd unreachable", &clamdScanner{Network: "unix", Address: "/nonexistent/clamd.sock"}, "hello", scanResult{}, true},
+		{"command clean", &commandScanner{Command: []string{"cat"}}, "hello", scanResult{}, false},
+		{"command infected", &commandScanner{Command: []string{"false"}}, "hello", scanResult{Infected: true}, false},
+		{"command missing", &commandScanner{Command: []string{"/nonexistent/scanner"}}, "hello", scanResult{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			result, err := tt.scanner.Scan(ctx, strings.NewReader(tt.data))
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, result)
+		})
+	}
+}
+
+func TestScanUpload(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           string
+		quarantineFile bool
+		wantStatus     string
+		wantMoved      bool
+		wantCode       int
+	}{
+		{"clean", "hello", false, scanClean, false, 0},
+		{"infected", "EICAR", false, scanInfected, true, http.StatusGone},
+		{"quarantine fails", "EICAR", true, scanInfected, false, http.StatusGone},
+	}
+	addr := fakeClamd(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t)
+			cfg.ScanClamd = "tcp:" + addr
+			cfg.ScanTimeoutSeconds = 5
+			cfg.QuarantineDirectory = filepath.Join(t.TempDir(), "quarantine")
+			if tt.quarantineFile {
+				// the quarantine can't be made
+				assert.Nil(t, os.WriteFile(cfg.QuarantineDirectory, nil, 0644))
+			}
+			setConfig(cfg)
+			p := writeTestUpload(t, "abc", "a.txt", []byte(tt.data))
+			p.Hash = "h"
+			p.ScanStatus = scanPending
+			assert.Nil(t, savePageInfo(p))
+			before := testutil.ToFloat64(metricStoredBytes)
+			size, _, _ := DirSize(filepath.Join(cfg.ContentDirectory, "abc"))
+
+			scanUpload(p)
+			moved, _ := filepath.Glob(filepath.Join(cfg.QuarantineDirectory, "abc-*"))
+			assert.Equal(t, tt.wantMoved, len(moved) == 1)
+			if tt.wantMoved {
+				assert.NoDirExists(t, filepath.Join(cfg.ContentDirectory, "abc"))
+				assert.Equal(t, before-float64(size), testutil.ToFloat64(metricStoredBytes))
+				// the information is kept with it
+				b, err := os.ReadFile(filepath.Join(moved[0], "abc.json.gz"))
+				assert.Nil(t, err)
+				gr, err := gzip.NewReader(bytes.NewReader(b))
+				assert.Nil(t, err)
+				var info Page
+				assert.Nil(t, json.NewDecoder(gr).Decode(&info))
+				assert.Equal(t, scanInfected, info.ScanStatus)
+				return
+			}
+			current, err := loadPageInfo("abc")
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantStatus, current.ScanStatus)
+			w := httptest.NewRecorder()
+			refused := current.refuseUnscanned(w, httptest.NewRequest("GET", "/1/abc/a.txt", nil))
+			assert.Equal(t, tt.wantCode != 0, refused)
+			if refused {
+				assert.Equal(t, tt.wantCode, w.Code)
+			}
+		})
+	}
+}
+
+func TestRefuseUnscanned(t *testing.T) {
+	for status, want := range map[string]int{
+		scanPending:  http.StatusServiceUnavailable,
+		scanError:    http.StatusServiceUnavailable,
+		scanInfected: http.StatusGone,
+		scanClean:    0,
+		"":           0,
+	} {
+		p := &Page{ScanStatus: status}
+		w := httptest.NewRecorder()
+		refused := p.refuseUnscanned(w, httptest.NewRequest("GET", "/1/abc/a.txt", nil))
+		assert.Equal(t, want != 0, refused, status)
+		if refused {
+			assert.Equal(t, want, w.Code, status)
+		}
+	}
+}
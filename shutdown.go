@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// uploadSessionsFile is where incomplete chunked uploads are saved
+// during shutdown so that they can be resumed after a restart
+const uploadSessionsFile = "sharesessions.json"
+
+// uploadSessionsMaxAge is how long saved upload sessions are kept
+// before they are considered abandoned
+const uploadSessionsMaxAge = 24 * time.Hour
+
+// shuttingDown is set to 1 once the server has started to shut down
+var shuttingDown int32
+
+// isShuttingDown returns whether the server is shutting down
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// uploadSessions is the saved state of the chunked uploads in progress
+type uploadSessions struct {
+	Saved      time.Time
+	InProgress map[string]int
+	FileNames  map[string]string
+	Started    map[string]time.Time
+}
+
+// saveUploadSessions writes the incomplete chunked uploads to the content
+// directory.
+func saveUploadSessions() (err error) {
+	cfg := getConfig()
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+
+	fname := path.Join(cfg.ContentDirectory, uploadSessionsFile)
+	if len(uploadsInProgress) == 0 {
+		os.Remove(fname)
+		return
+	}
+	b, err := json.MarshalIndent(uploadSessions{
+		Saved:      time.Now(),
+		InProgress: uploadsInProgress,
+		FileNames:  uploadsFileNames,
+		Started:    uploadsStarted,
+	}, "", " ")
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(fname, b, 0644)
+	if err == nil {
+		log.Infof("saved %d incomplete uploads", len(uploadsInProgress))
+	}
+	return
+}
+
+// loadUploadSessions restores the incomplete chunked uploads that were
+// saved during the last shutdown. Chunks that have gone missing are
+// dropped so that the client will upload them again.
+func loadUploadSessions() (err error) {
+	cfg := getConfig()
+	fname := path.Join(cfg.ContentDirectory, uploadSessionsFile)
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer os.Remove(fname)
+
+	var sessions uploadSessions
+	err = json.Unmarshal(b, &sessions)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %s", fname, err.Error())
+	}
+
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+	for uuid := range sessions.InProgress {
+		started, ok := sessions.Started[uuid]
+		if !ok {
+			// saved before the start times were
+			started = sessions.Saved
+		}
+		abandoned := time.Since(started) > uploadSessionsMaxAge
+		if abandoned {
+			log.Infof("discarding abandoned upload %s", uuid)
+		}
+		for key, chunkFile := range sessions.FileNames {
+			if !isChunkOf(key, uuid) {
+				continue
+			}
+			if abandoned {
+				os.Remove(chunkFile)
+				continue
+			}
+			if _, errStat := os.Stat(chunkFile); errStat != nil {
+				log.Debugf("dropping missing chunk %s", chunkFile)
+				continue
+			}
+			uploadsFileNames[key] = chunkFile
+			uploadsInProgress[uuid]++
+		}
+		if !abandoned {
+			uploadsStarted[uuid] = started
+		}
+	}
+	log.Infof("restored %d incomplete uploads", len(uploadsInProgress))
+	return
+}
+
+// isChunkOf returns whether the key of a chunk, the uuid followed by the
+// number of the chunk, belongs to the upload
+func isChunkOf(key string, uuid string) bool {
+	num := strings.TrimPrefix(key, uuid)
+	if num == key || num == "" {
+		return false
+	}
+	_, err := strconv.Atoi(num)
+	return err == nil
+}
+
+// expireUploadSessions drops the chunked uploads that were started longer
+// than uploadSessionsMaxAge ago, with their chunks
+func expireUploadSessions() {
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+	for uuid, started := range uploadsStarted {
+		if time.Since(started) <= uploadSessionsMaxAge {
+			continue
+		}
+		log.Infof("discarding abandoned upload %s", uuid)
+		for key, chunkFile := range uploadsFileNames {
+			if isChunkOf(key, uuid) {
+				os.Remove(chunkFile)
+				delete(uploadsFileNames, key)
+			}
+		}
+		delete(uploadsInProgress, uuid)
+		delete(uploadsStarted, uuid)
+		delete(uploadsClients, uuid)
+	}
+}
+
+// isUploadSessionFile returns whether a temp file is a chunk of an upload
+// that is still in progress.
+func isUploadSessionFile(name string) bool {
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+	for _, chunkFile := range uploadsFileNames {
+		if filepath.Base(chunkFile) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// serveUntilShutdown runs the server (and the optional HTTP redirect server)
+// until SIGINT or SIGTERM is received and then shuts it down gracefully: new
+// uploads are refused, in-flight requests are given until the shutdown
+// timeout to finish, the cleanup routine is stopped and the incomplete
+// chunked uploads are saved.
+func serveUntilShutdown(server *http.Server, redirectServer *http.Server, stopCleanup chan struct{}, cleanupDone chan struct{}) {
+	serverErr := make(chan error, 2)
+	go func() {
+		if server.TLSConfig != nil {
+			serverErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+	if redirectServer != nil {
+		go func() {
+			serverErr <- redirectServer.ListenAndServe()
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		log.Error(err)
+		os.Exit(1)
+	case sig := <-stop:
+		log.Infof("received %s, shutting down", sig)
+	}
+
+	atomic.StoreInt32(&shuttingDown, 1)
+	timeout := time.Duration(getConfig().ShutdownSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("shutdown did not finish after %s: %s", timeout, err.Error())
+	}
+
+	close(stopCleanup)
+	<-cleanupDone
+
+	if err := saveUploadSessions(); err != nil {
+		log.Errorf("could not save incomplete uploads: %s", err.Error())
+	}
+	log.Info("shutdown complete")
+}
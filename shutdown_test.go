@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// resetUploads empties the state of the chunked uploads
+func resetUploads() {
+	uploadsInProgress = make(map[string]int)
+	uploadsFileNames = make(map[string]string)
+	uploadsStarted = make(map[string]time.Time)
+	uploadsClients = make(map[string]string)
+}
+
+func TestUploadSessions(t *testing.T) {
+	tests := []struct {
+		name        string
+		saved       time.Duration
+		started     time.Duration
+		missing     []string
+		want        map[string]int
+		wantRemoved []string
+	}{
+		{
+			name: "all chunks",
+			want: map[string]int{"abc": 2, "def": 1},
+		},
+		{
+			name:    "missing chunk",
+			missing: []string{"abc2"},
+			want:    map[string]int{"abc": 1, "def": 1},
+		},
+		{
+			name:        "abandoned",
+			saved:       2 * uploadSessionsMaxAge,
+			started:     2 * uploadSessionsMaxAge,
+			want:        map[string]int{},
+			wantRemoved: []string{"abc1", "abc2", "def1"},
+		},
+		{
+			name:        "one abandoned",
+			started:     2 * uploadSessionsMaxAge,
+			want:        map[string]int{"def": 1},
+			wantRemoved: []string{"abc1", "abc2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := useTestConfig(t)
+			resetUploads()
+			for _, key := range []string{"abc1", "abc2", "def1"} {
+				fname := path.Join(cfg.ContentDirectory, "sharetemp"+key)
+				assert.Nil(t, os.WriteFile(fname, []byte(key), 0644))
+				uploadsFileNames[key] = fname
+			}
+			uploadsInProgress["abc"] = 2
+			uploadsInProgress["def"] = 1
+			uploadsStarted["abc"] = time.Now().Add(-tt.started)
+			uploadsStarted["def"] = time.Now()
+			assert.Nil(t, saveUploadSessions())
+
+			fname := path.Join(cfg.ContentDirectory, uploadSessionsFile)
+			if tt.saved > 0 {
+				b, _ := os.ReadFile(fname)
+				var sessions uploadSessions
+				assert.Nil(t, json.Unmarshal(b, &sessions))
+				sessions.Saved = time.Now().Add(-tt.saved)
+				sessions.Started["def"] = sessions.Saved
+				b, _ = json.Marshal(sessions)
+				assert.Nil(t, os.WriteFile(fname, b, 0644))
+			}
+			for _, key := range tt.missing {
+				os.Remove(uploadsFileNames[key])
+			}
+
+			chunkFiles := make(map[string]string)
+			for key, chunkFile := range uploadsFileNames {
+				chunkFiles[key] = chunkFile
+			}
+
+			resetUploads()
+			assert.Nil(t, loadUploadSessions())
+			assert.Equal(t, tt.want, uploadsInProgress)
+			for _, key := range tt.wantRemoved {
+				assert.NoFileExists(t, chunkFiles[key])
+			}
+			assert.NoFileExists(t, fname)
+			for _, key := range tt.missing {
+				assert.False(t, isUploadSessionFile("sharetemp"+key))
+			}
+			if len(tt.want) > 0 {
+				assert.True(t, isUploadSessionFile("sharetempdef1"))
+			}
+		})
+	}
+}
+
+func TestExpireUploadSessions(t *testing.T) {
+	cfg := useTestConfig(t)
+	resetUploads()
+	t.Cleanup(resetUploads)
+	for _, key := range []string{"abc1", "abc10", "def1"} {
+		fname := path.Join(cfg.ContentDirectory, "sharetemp"+key)
+		assert.Nil(t, os.WriteFile(fname, []byte(key), 0644))
+		uploadsFileNames[key] = fname
+	}
+	uploadsInProgress["abc"] = 2
+	uploadsInProgress["def"] = 1
+	uploadsStarted["abc"] = time.Now().Add(-2 * uploadSessionsMaxAge)
+	uploadsStarted["def"] = time.Now()
+	uploadsClients["abc"] = "1.2.3.4"
+
+	expireUploadSessions()
+	assert.Equal(t, map[string]int{"def": 1}, uploadsInProgress)
+	assert.NotContains(t, uploadsStarted, "abc")
+	assert.NotContains(t, uploadsClients, "abc")
+	assert.Len(t, uploadsFileNames, 1)
+	assert.NoFileExists(t, path.Join(cfg.ContentDirectory, "sharetempabc10"))
+	assert.FileExists(t, path.Join(cfg.ContentDirectory, "sharetempdef1"))
+}
+
+func TestIsChunkOf(t *testing.T) {
+	assert.True(t, isChunkOf("abc1", "abc"))
+	assert.True(t, isChunkOf("abc12", "abc"))
+	assert.False(t, isChunkOf("abc", "abc"))
+	assert.False(t, isChunkOf("abcd1", "abc"))
+	assert.False(t, isChunkOf("def1", "abc"))
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// stripMaxHeader is how much metadata can come before the image data of a
+// JPEG, which is kept in memory while stripping
+const stripMaxHeader = 16 * 1024 * 1024
+
+// image formats that metadata can be stripped from
+const (
+	stripJPEG = "jpeg"
+	stripPNG  = "png"
+	stripWebP = "webp"
+)
+
+// stripFormat returns the format of an image from its first bytes, or ""
+// if metadata can not be stripped from it
+func stripFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return stripJPEG
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return stripPNG
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return stripWebP
+	}
+	return ""
+}
+
+// stripRequested returns whether the uploader asked for the metadata of
+// their upload to be stripped, with ?strip (or ?strip=true) or an
+// X-Strip-Metadata header
+func stripRequested(r *http.Request) bool {
+	if values, ok := r.URL.Query()["strip"]; ok {
+		return parseStrip(values[0])
+	}
+	strip, _ := strconv.ParseBool(r.Header.Get("X-Strip-Metadata"))
+	return strip
+}
+
+// parseStrip parses the value of ?strip or of the strip field of a form,
+// where no value means true
+func parseStrip(value string) bool {
+	if value == "" {
+		return true
+	}
+	strip, _ := strconv.ParseBool(value)
+	return strip
+}
+
+// stripUploadMetadata strips the metadata from a gzipped upload in place, if
+// it is a JPEG, PNG or WebP image, and returns its new (uncompressed) size
+func stripUploadMetadata(fname string) (stripped bool, size int64, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return
+	}
+	defer gz.Close()
+	br := bufio.NewReader(gz)
+	head, _ := br.Peek(12)
+	format := stripFormat(head)
+	if format == "" {
+		return
+	}
+
+	// the image is decompressed first, because WebP needs to be read twice
+	raw, err := os.CreateTemp(filepath.Dir(fname), "sharestrip")
+	if err != nil {
+		return
+	}
+	defer os.Remove(raw.Name())
+	defer raw.Close()
+	if _, err = io.Copy(raw, br); err != nil {
+		return
+	}
+	if _, err = raw.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(fname), "sharestrip")
+	if err != nil {
+		return
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	gzOut := gzip.NewWriter(out)
+	counter := &countingWriter{Writer: gzOut}
+	switch format {
+	case stripJPEG:
+		err = stripJPEGMetadata(counter, bufio.NewReader(raw))
+	case stripPNG:
+		err = stripPNGMetadata(counter, bufio.NewReader(raw))
+	case stripWebP:
+		err = stripWebPMetadata(counter, raw)
+	}
+	if err != nil {
+		return false, 0, fmt.Errorf("%s: %s", format, err.Error())
+	}
+	if err = gzOut.Close(); err != nil {
+		return
+	}
+	if err = out.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(out.Name(), fname); err != nil {
+		return
+	}
+	return true, counter.N, nil
+}
+
+// JPEG markers
+const (
+	jpegSOS  = 0xDA
+	jpegEOI  = 0xD9
+	jpegAPP0 = 0xE0
+	jpegAPP1 = 0xE1
+	jpegAPP2 = 0xE2
+	jpegAPPE = 0xEE
+	jpegCOM  = 0xFE
+)
+
+// jpegSegment is a marker segment of a JPEG
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+}
+
+// keepJPEGSegment returns whether a segment does not hold metadata. Of the
+// application segments, only JFIF, ICC profiles and the Adobe segment
+// (which says how colors are stored) are kept, as the others hold Exif,
+// XMP, IPTC and whatever else cameras and editors add.
+func keepJPEGSegment(s jpegSegment) bool {
+	switch {
+	case s.marker == jpegAPP0:
+		return bytes.HasPrefix(s.payload, []byte("JFIF\x00")) || bytes.HasPrefix(s.payload, []byte("JFXX\x00"))
+	case s.marker == jpegAPP2:
+		return bytes.HasPrefix(s.payload, []byte("ICC_PROFILE\x00"))
+	case s.marker == jpegAPPE:
+		return bytes.HasPrefix(s.payload, []byte("Adobe"))
+	case s.marker > jpegAPP0 && s.marker < 0xF0, s.marker == jpegCOM:
+		return false
+	}
+	return true
+}
+
+// stripJPEGMetadata copies a JPEG without its metadata segments. The
+// orientation is kept in a new Exif segment, since photos are shown
+// sideways without it.
+func stripJPEGMetadata(w io.Writer, r *bufio.Reader) (err error) {
+	soi := make([]byte, 2)
+	if _, err = io.ReadFull(r, soi); err != nil {
+		return
+	}
+	var segments []jpegSegment
+	var orientation uint16
+	headerSize := 0
+	for {
+		var marker byte
+		if marker, err = readJPEGMarker(r); err != nil {
+			return
+		}
+		if marker == jpegEOI {
+			// no image data
+			segments = append(segments, jpegSegment{marker: marker})
+			break
+		}
+		if marker >= 0xD0 && marker <= 0xD7 || marker == 0x01 {
+			// markers without a payload
+			segments = append(segments, jpegSegment{marker: marker})
+			continue
+		}
+		var length uint16
+		if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+			return
+		}
+		if length < 2 {
+			return fmt.Errorf("bad segment length %d", length)
+		}
+		headerSize += int(length)
+		if headerSize > stripMaxHeader {
+			return fmt.Errorf("more than %d bytes of metadata", stripMaxHeader)
+		}
+		s := jpegSegment{marker: marker, payload: make([]byte, length-2)}
+		if _, err = io.ReadFull(r, s.payload); err != nil {
+			return
+		}
+		if marker == jpegAPP1 && orientation == 0 {
+			orientation = exifOrientation(s.payload)
+		}
+		if keepJPEGSegment(s) {
+			segments = append(segments, s)
+		}
+		if marker == jpegSOS {
+			break
+		}
+	}
+
+	if _, err = w.Write(soi); err != nil {
+		return
+	}
+	exifWritten := orientation < 2 || orientation > 8
+	for _, s := range segments {
+		if !exifWritten && s.marker != jpegAPP0 {
+			// Exif comes right after JFIF
+			if err = writeJPEGSegment(w, jpegSegment{marker: jpegAPP1, payload: orientationExif(orientation)}); err != nil {
+				return
+			}
+			exifWritten = true
+		}
+		if err = writeJPEGSegment(w, s); err != nil {
+			return
+		}
+	}
+	if segments[len(segments)-1].marker == jpegEOI {
+		return
+	}
+	return copyJPEGScans(w, r)
+}
+
+// copyJPEGScans copies the image data of a JPEG, from after the first SOS
+// segment up to the EOI marker. Segments between the scans (of progressive
+// JPEGs) are filtered like the ones before them, and whatever follows the
+// EOI (like the other images of an MPF file) is dropped.
+func copyJPEGScans(w io.Writer, r *bufio.Reader) (err error) {
+	for {
+		var data []byte
+		data, err = r.ReadSlice(0xFF)
+		if err == bufio.ErrBufferFull {
+			if _, err = w.Write(data); err != nil {
+				return
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("no end of image: %s", err.Error())
+		}
+		if _, err = w.Write(data[:len(data)-1]); err != nil {
+			return
+		}
+
+		marker := byte(0xFF)
+		for marker == 0xFF {
+			if marker, err = r.ReadByte(); err != nil {
+				return fmt.Errorf("no end of image: %s", err.Error())
+			}
+		}
+		switch {
+		case marker == 0x00 || (marker >= 0xD0 && marker <= 0xD7):
+			// a 0xFF in the data, or a restart marker
+			_, err = w.Write([]byte{0xFF, marker})
+		case marker == jpegEOI:
+			_, err = w.Write([]byte{0xFF, marker})
+			return
+		default:
+			var length uint16
+			if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+				return
+			}
+			if length < 2 {
+				return fmt.Errorf("bad segment length %d", length)
+			}
+			s := jpegSegment{marker: marker, payload: make([]byte, length-2)}
+			if _, err = io.ReadFull(r, s.payload); err != nil {
+				return
+			}
+			if keepJPEGSegment(s) {
+				err = writeJPEGSegment(w, s)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readJPEGMarker reads the next marker, skipping the fill bytes before it
+func readJPEGMarker(r *bufio.Reader) (marker byte, err error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	if b != 0xFF {
+		return 0, fmt.Errorf("expected a marker, got 0x%02x", b)
+	}
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return
+		}
+	}
+	return b, nil
+}
+
+// writeJPEGSegment writes a marker and its payload, if it has one
+func writeJPEGSegment(w io.Writer, s jpegSegment) (err error) {
+	if _, err = w.Write([]byte{0xFF, s.marker}); err != nil {
+		return
+	}
+	if s.payload == nil {
+		return
+	}
+	if err = binary.Write(w, binary.BigEndian, uint16(len(s.payload)+2)); err != nil {
+		return
+	}
+	_, err = w.Write(s.payload)
+	return
+}
+
+// exifOrientationTag is the tag of the orientation in the first IFD of Exif
+const exifOrientationTag = 0x0112
+
+// exifOrientation returns the orientation in an Exif segment, or 0 if it
+// has none
+func exifOrientation(payload []byte) uint16 {
+	if !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := payload[6:]
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int64(order.Uint32(tiff[4:8]))
+	if ifd+2 > int64(len(tiff)) {
+		return 0
+	}
+	count := int64(order.Uint16(tiff[ifd:]))
+	for i := int64(0); i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > int64(len(tiff)) {
+			return 0
+		}
+		// the orientation is a SHORT (3)
+		if order.Uint16(tiff[entry:]) == exifOrientationTag && order.Uint16(tiff[entry+2:]) == 3 {
+			return order.Uint16(tiff[entry+8:])
+		}
+	}
+	return 0
+}
+
+// orientationExif returns an Exif segment with only the orientation
+func orientationExif(orientation uint16) []byte {
+	var b bytes.Buffer
+	b.WriteString("Exif\x00\x00")
+	// big endian TIFF header, with the first IFD right after it
+	b.WriteString("MM\x00\x2a\x00\x00\x00\x08")
+	binary.Write(&b, binary.BigEndian, uint16(1))
+	binary.Write(&b, binary.BigEndian, []uint16{exifOrientationTag, 3})
+	binary.Write(&b, binary.BigEndian, uint32(1))
+	binary.Write(&b, binary.BigEndian, []uint16{orientation, 0})
+	// no next IFD
+	binary.Write(&b, binary.BigEndian, uint32(0))
+	return b.Bytes()
+}
+
+// pngMetadataChunks are the chunks of a PNG that hold metadata
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata copies a PNG without its metadata chunks
+func stripPNGMetadata(w io.Writer, r io.Reader) (err error) {
+	signature := make([]byte, 8)
+	if _, err = io.ReadFull(r, signature); err != nil {
+		return
+	}
+	if _, err = w.Write(signature); err != nil {
+		return
+	}
+	header := make([]byte, 8)
+	for {
+		if _, err = io.ReadFull(r, header); err != nil {
+			return
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:8])
+		// the data and the CRC
+		rest := length + 4
+		if pngMetadataChunks[chunkType] {
+			_, err = io.CopyN(io.Discard, r, rest)
+		} else if _, err = w.Write(header); err == nil {
+			_, err = io.CopyN(w, r, rest)
+		}
+		if err != nil || chunkType == "IEND" {
+			return
+		}
+	}
+}
+
+// webpMetadataChunks are the chunks of a WebP that hold metadata
+var webpMetadataChunks = map[string]bool{
+	"EXIF": true,
+	"XMP ": true,
+}
+
+// flags of the VP8X chunk of a WebP that say it has metadata
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// stripWebPMetadata copies a WebP without its metadata chunks. The size of
+// the file comes first, so the chunks are read twice.
+func stripWebPMetadata(w io.Writer, r io.ReadSeeker) (err error) {
+	size := int64(4)
+	err = walkWebPChunks(r, func(fourCC string, header []byte, length int64) error {
+		if !webpMetadataChunks[fourCC] {
+			size += 8 + length + length%2
+		}
+		_, err := r.Seek(length+length%2, io.SeekCurrent)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	if size > 0xFFFFFFFF {
+		return fmt.Errorf("too big")
+	}
+
+	riff := []byte("RIFF\x00\x00\x00\x00WEBP")
+	binary.LittleEndian.PutUint32(riff[4:8], uint32(size))
+	if _, err = w.Write(riff); err != nil {
+		return
+	}
+	return walkWebPChunks(r, func(fourCC string, header []byte, length int64) (err error) {
+		padded := length + length%2
+		if webpMetadataChunks[fourCC] {
+			_, err = r.Seek(padded, io.SeekCurrent)
+			return
+		}
+		if _, err = w.Write(header); err != nil {
+			return
+		}
+		if fourCC == "VP8X" && length > 0 {
+			flags := make([]byte, 1)
+			if _, err = io.ReadFull(r, flags); err != nil {
+				return
+			}
+			flags[0] &^= webpFlagEXIF | webpFlagXMP
+			if _, err = w.Write(flags); err != nil {
+				return
+			}
+			padded--
+		}
+		_, err = io.CopyN(w, r, padded)
+		return
+	})
+}
+
+// walkWebPChunks calls fn with the header of each chunk of a WebP, with r
+// at the start of the data of the chunk. fn must read or skip the data.
+func walkWebPChunks(r io.ReadSeeker, fn func(fourCC string, header []byte, length int64) error) (err error) {
+	riff := make([]byte, 12)
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(r, riff); err != nil {
+		return
+	}
+	end := 8 + int64(binary.LittleEndian.Uint32(riff[4:8]))
+	offset := int64(12)
+	for offset+8 <= end {
+		header := make([]byte, 8)
+		if _, err = io.ReadFull(r, header); err != nil {
+			return
+		}
+		length := int64(binary.LittleEndian.Uint32(header[4:8]))
+		if err = fn(string(header[:4]), header, length); err != nil {
+			return
+		}
+		offset += 8 + length + length%2
+	}
+	return
+}
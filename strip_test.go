@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// jpegSegmentBytes returns a marker segment with its payload
+func jpegSegmentBytes(marker byte, payload string) []byte {
+	var buf bytes.Buffer
+	writeJPEGSegment(&buf, jpegSegment{marker: marker, payload: []byte(payload)})
+	return buf.Bytes()
+}
+
+// testJPEG encodes a small JPEG and adds segments after the SOI and data
+// after the EOI
+func testJPEG(t *testing.T, segments [][]byte, trailer string) []byte {
+	var buf bytes.Buffer
+	assert.Nil(t, jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 16, 16)), nil))
+	b := buf.Bytes()
+	out := append([]byte{}, b[:2]...)
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	out = append(out, b[2:]...)
+	return append(out, trailer...)
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	exif := jpegSegmentBytes(jpegAPP1, string(orientationExif(6))+"GPS 51.5N 0.1W")
+	xmp := jpegSegmentBytes(jpegAPP1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")
+	comment := jpegSegmentBytes(jpegCOM, "secret comment")
+	icc := jpegSegmentBytes(jpegAPP2, "ICC_PROFILE\x00profile")
+	tests := []struct {
+		name            string
+		data            []byte
+		wantOrientation uint16
+		wantGone        []string
+		wantKept        []string
+		wantErr         bool
+	}{
+		{
+			name: "no metadata",
+			data: testJPEG(t, nil, ""),
+		},
+		{
+			name:            "exif, xmp and comments",
+			data:            testJPEG(t, [][]byte{exif, xmp, comment, icc}, ""),
+			wantOrientation: 6,
+			wantGone:        []string{"GPS", "xmpmeta", "secret comment"},
+			wantKept:        []string{"ICC_PROFILE"},
+		},
+		{
+			name:     "data after the end of the image",
+			data:     testJPEG(t, nil, "\xFF\xD8\xFF\xE1\x00\x0cGPS 51.5N\xFF\xD9"),
+			wantGone: []string{"GPS"},
+		},
+		{
+			name:    "truncated",
+			data:    testJPEG(t, [][]byte{exif}, "")[:300],
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := stripJPEGMetadata(&out, bufio.NewReader(bytes.NewReader(tt.data)))
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			for _, s := range tt.wantGone {
+				assert.NotContains(t, out.String(), s)
+			}
+			for _, s := range tt.wantKept {
+				assert.Contains(t, out.String(), s)
+			}
+			assert.True(t, bytes.HasSuffix(out.Bytes(), []byte{0xFF, jpegEOI}))
+			assert.Equal(t, tt.wantOrientation, jpegOrientationOf(out.Bytes()))
+			_, err = jpeg.Decode(bytes.NewReader(out.Bytes()))
+			assert.Nil(t, err)
+		})
+	}
+}
+
+// jpegOrientationOf returns the orientation in the first Exif segment
+func jpegOrientationOf(b []byte) uint16 {
+	i := bytes.Index(b, []byte("Exif\x00\x00"))
+	if i < 0 {
+		return 0
+	}
+	return exifOrientation(b[i:])
+}
+
+func TestCopyJPEGScans(t *testing.T) {
+	// the scan data with a stuffed 0xFF, fill bytes, a restart marker, a
+	// table and a comment between two scans, then the end and another image
+	scans := "\x01\x02\xFF\x00\x03\xFF\xFF\xD0\x04" +
+		string(jpegSegmentBytes(0xC4, "table")) + string(jpegSegmentBytes(jpegCOM, "comment")) +
+		string(jpegSegmentBytes(jpegSOS, "scan")) + "\x05\xFF\xD9" + "\xFF\xD8second image\xFF\xD9"
+	var out bytes.Buffer
+	assert.Nil(t, copyJPEGScans(&out, bufio.NewReader(bytes.NewReader([]byte(scans)))))
+	want := "\x01\x02\xFF\x00\x03\xFF\xD0\x04" +
+		string(jpegSegmentBytes(0xC4, "table")) +
+		string(jpegSegmentBytes(jpegSOS, "scan")) + "\x05\xFF\xD9"
+	assert.Equal(t, []byte(want), out.Bytes())
+}
+
+func TestExifOrientation(t *testing.T) {
+	for orientation := uint16(1); orientation <= 8; orientation++ {
+		assert.Equal(t, orientation, exifOrientation(orientationExif(orientation)))
+	}
+	// little endian, with another tag first
+	var b bytes.Buffer
+	b.WriteString("Exif\x00\x00II\x2a\x00\x08\x00\x00\x00")
+	binary.Write(&b, binary.LittleEndian, uint16(2))
+	binary.Write(&b, binary.LittleEndian, []uint16{0x010F, 2, 4, 0, 0, 0})
+	binary.Write(&b, binary.LittleEndian, []uint16{exifOrientationTag, 3, 1, 0, 3, 0})
+	assert.Equal(t, uint16(3), exifOrientation(b.Bytes()))
+	assert.Equal(t, uint16(0), exifOrientation([]byte("Exif\x00\x00MM")))
+	assert.Equal(t, uint16(0), exifOrientation([]byte("http://ns.adobe.com/xap/1.0/")))
+	assert.Equal(t, uint16(0), exifOrientation(b.Bytes()[:20]))
+}
+
+// pngChunk returns a PNG chunk (with a CRC that is not checked here)
+func pngChunk(chunkType string, data string) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], chunkType)
+	return append(append(b, data...), 0, 0, 0, 0)
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4))))
+	encoded := buf.Bytes()
+	// metadata goes after the IHDR chunk, which is 8+13+4 bytes
+	ihdrEnd := 8 + 25
+	data := append([]byte{}, encoded[:ihdrEnd]...)
+	data = append(data, pngChunk("tEXt", "Comment\x00secret")...)
+	data = append(data, pngChunk("eXIf", "MM GPS")...)
+	data = append(data, pngChunk("tIME", "1234567")...)
+	data = append(data, encoded[ihdrEnd:]...)
+	data = append(data, "trailing"...)
+
+	var out bytes.Buffer
+	assert.Nil(t, stripPNGMetadata(&out, bytes.NewReader(data)))
+	assert.Equal(t, encoded, out.Bytes())
+
+	assert.NotNil(t, stripPNGMetadata(&bytes.Buffer{}, bytes.NewReader(data[:40])))
+}
+
+// webpChunk returns a WebP chunk, padded to an even length
+func webpChunk(fourCC string, data string) []byte {
+	b := make([]byte, 8)
+	copy(b, fourCC)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// webpFile returns a WebP with the chunks
+func webpFile(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	b := []byte("RIFF\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(body)))
+	return append(b, body...)
+}
+
+func TestStripWebPMetadata(t *testing.T) {
+	vp8x := "\x0c\x00\x00\x00\x0f\x00\x00\x0f\x00\x00"
+	data := webpFile(
+		webpChunk("VP8X", vp8x),
+		webpChunk("ICCP", "profile"),
+		webpChunk("VP8L", "image data"),
+		webpChunk("EXIF", "MM GPS"),
+		webpChunk("XMP ", "<x:xmpmeta/>"),
+	)
+	want := webpFile(
+		webpChunk("VP8X", "\x00"+vp8x[1:]),
+		webpChunk("ICCP", "profile"),
+		webpChunk("VP8L", "image data"),
+	)
+	var out bytes.Buffer
+	assert.Nil(t, stripWebPMetadata(&out, bytes.NewReader(data)))
+	assert.Equal(t, want, out.Bytes())
+}
+
+func TestStripFormat(t *testing.T) {
+	for head, want := range map[string]string{
+		"\xFF\xD8\xFF\xE0":         stripJPEG,
+		"\x89PNG\r\n\x1a\n":        stripPNG,
+		"RIFF\x00\x00\x00\x00WEBP": stripWebP,
+		"RIFF\x00\x00\x00\x00WAVE": "",
+		"GIF89a":                   "",
+		"":                         "",
+	} {
+		assert.Equal(t, want, stripFormat([]byte(head)), head)
+	}
+}
+
+func TestStripRequested(t *testing.T) {
+	tests := []struct {
+		url    string
+		header string
+		want   bool
+	}{
+		{"/photo.jpg", "", false},
+		{"/photo.jpg?strip", "", true},
+		{"/photo.jpg?strip=1", "", true},
+		{"/photo.jpg?strip=true", "", true},
+		{"/photo.jpg?strip=0", "", false},
+		{"/photo.jpg?strip=false", "", false},
+		{"/photo.jpg?strip=no", "", false},
+		{"/photo.jpg?strip=0", "true", false},
+		{"/photo.jpg", "true", true},
+		{"/photo.jpg", "1", true},
+		{"/photo.jpg", "no", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("PUT", tt.url, nil)
+		if tt.header != "" {
+			r.Header.Set("X-Strip-Metadata", tt.header)
+		}
+		assert.Equal(t, tt.want, stripRequested(r), tt.url+" "+tt.header)
+	}
+}
+
+func TestStripUploadMetadata(t *testing.T) {
+	exif := jpegSegmentBytes(jpegAPP1, string(orientationExif(1))+"GPS 51.5N 0.1W")
+	withExif := testJPEG(t, [][]byte{exif}, "")
+	tests := []struct {
+		name         string
+		data         []byte
+		wantStripped bool
+		wantErr      bool
+	}{
+		{"jpeg", withExif, true, false},
+		{"text", []byte("hello"), false, false},
+		{"broken jpeg", withExif[:100], false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "upload")
+			assert.Nil(t, os.WriteFile(fname, gzipped(tt.data).Bytes(), 0644))
+			stripped, size, err := stripUploadMetadata(fname)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.wantStripped, stripped)
+			if !tt.wantStripped {
+				return
+			}
+			p := &Page{NameOnDisk: fname, Size: size}
+			b, err := p.readData(-1)
+			assert.Nil(t, err)
+			assert.Equal(t, int64(len(b)), size)
+			assert.NotContains(t, string(b), "GPS")
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// textSampleSize is how much of an upload is looked at to decide whether it
+// is text
+const textSampleSize = 64 * 1024
+
+// charsets of text uploads
+const (
+	charsetUTF8    = "utf-8"
+	charsetUTF16LE = "utf-16le"
+	charsetUTF16BE = "utf-16be"
+)
+
+// classifyText returns whether a sample of data is text, and its charset.
+// Text is valid UTF-8 (with or without a BOM) without control characters
+// other than whitespace and escape (for colors in logs), or starts with a
+// UTF-16 BOM. truncated says whether the sample was cut from longer data,
+// so that a character that is cut in half at the end does not count.
+func classifyText(sample []byte, truncated bool) (isText bool, charset string) {
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		return isUTF16Text(sample[2:], false), charsetUTF16LE
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		return isUTF16Text(sample[2:], true), charsetUTF16BE
+	}
+	sample = bytes.TrimPrefix(sample, []byte{0xEF, 0xBB, 0xBF})
+	if truncated {
+		// drop a character that is cut in half
+		for i := 1; i < utf8.UTFMax && i <= len(sample); i++ {
+			if utf8.RuneStart(sample[len(sample)-i]) {
+				if !utf8.FullRune(sample[len(sample)-i:]) {
+					sample = sample[:len(sample)-i]
+				}
+				break
+			}
+		}
+	}
+	if !utf8.Valid(sample) {
+		return false, ""
+	}
+	for _, b := range sample {
+		if isBinaryByte(b) {
+			return false, ""
+		}
+	}
+	return true, charsetUTF8
+}
+
+// isUTF16Text returns whether UTF-16 data has no control characters other
+// than whitespace
+func isUTF16Text(sample []byte, bigEndian bool) bool {
+	for i := 0; i+1 < len(sample); i += 2 {
+		hi, lo := sample[i], sample[i+1]
+		if !bigEndian {
+			hi, lo = lo, hi
+		}
+		if hi == 0 && isBinaryByte(lo) {
+			return false
+		}
+	}
+	return true
+}
+
+// isBinaryByte returns whether a byte is a control character that does not
+// appear in text
+func isBinaryByte(b byte) bool {
+	switch b {
+	case '\t', '\n', '\v', '\f', '\r', 0x1B:
+		return false
+	}
+	return b < 0x20 || b == 0x7F
+}
+
+// withCharset adds the charset to a text content type
+func withCharset(contentType string, charset string) string {
+	if charset == "" || strings.Contains(contentType, "charset=") {
+		return contentType
+	}
+	return contentType + "; charset=" + charset
+}
+
+// Charset returns the charset of a text upload, which is UTF-8 unless the
+// content type says otherwise
+func (p *Page) Charset() string {
+	_, params, err := mime.ParseMediaType(p.ContentType)
+	if err == nil && params["charset"] != "" {
+		return strings.ToLower(params["charset"])
+	}
+	return charsetUTF8
+}
+
+// decodeText decodes text in the charset of the upload to UTF-8, without
+// the BOM
+func (p *Page) decodeText(r io.Reader) io.Reader {
+	switch p.Charset() {
+	case charsetUTF16LE:
+		return transform.NewReader(r, unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder())
+	case charsetUTF16BE:
+		return transform.NewReader(r, unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM).NewDecoder())
+	}
+	return transform.NewReader(r, unicode.UTF8BOM.NewDecoder())
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyText(t *testing.T) {
+	tests := []struct {
+		name        string
+		sample      string
+		truncated   bool
+		wantText    bool
+		wantCharset string
+	}{
+		{"ascii", "hello\tworld\r\n", false, true, charsetUTF8},
+		{"utf-8", "héllo 日本語", false, true, charsetUTF8},
+		{"utf-8 bom", "\xEF\xBB\xBFhello", false, true, charsetUTF8},
+		{"colors", "\x1b[31mred\x1b[0m\n", false, true, charsetUTF8},
+		{"empty", "", false, true, charsetUTF8},
+		{"nul", "hello\x00world", false, false, ""},
+		{"control", "hello\x01", false, false, ""},
+		{"delete", "hello\x7f", false, false, ""},
+		{"invalid utf-8", "hello\xff", false, false, ""},
+		{"cut character", "hello 日"[:8], true, true, charsetUTF8},
+		{"cut character at the end", "hello 日"[:8], false, false, ""},
+		{"utf-16le", "\xFF\xFEh\x00i\x00", false, true, charsetUTF16LE},
+		{"utf-16be", "\xFE\xFF\x00h\x00i", false, true, charsetUTF16BE},
+		{"binary utf-16le", "\xFF\xFEh\x00\x01\x00", false, false, charsetUTF16LE},
+		{"png", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", false, false, ""},
+	}
+	for _, tt := range tests {
+		isText, charset := classifyText([]byte(tt.sample), tt.truncated)
+		assert.Equal(t, tt.wantText, isText, tt.name)
+		if tt.wantText || tt.wantCharset != "" {
+			assert.Equal(t, tt.wantCharset, charset, tt.name)
+		}
+	}
+}
+
+func TestWithCharset(t *testing.T) {
+	assert.Equal(t, "text/plain; charset=utf-8", withCharset("text/plain", charsetUTF8))
+	assert.Equal(t, "text/plain; charset=utf-16le", withCharset("text/plain; charset=utf-16le", charsetUTF8))
+	assert.Equal(t, "image/png", withCharset("image/png", ""))
+}
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		contentType string
+		data        string
+		want        string
+	}{
+		{"text/plain", "héllo", "héllo"},
+		{"text/plain; charset=utf-8", "\xEF\xBB\xBFhéllo", "héllo"},
+		{"text/plain; charset=UTF-16LE", "\xFF\xFEh\x00\xe9\x00", "hé"},
+		{"text/plain; charset=utf-16be", "\xFE\xFF\x00h\x00\xe9", "hé"},
+	}
+	for _, tt := range tests {
+		p := &Page{ContentType: tt.contentType}
+		b, err := io.ReadAll(p.decodeText(strings.NewReader(tt.data)))
+		assert.Nil(t, err)
+		assert.Equal(t, tt.want, string(b), tt.contentType)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/schollz/logger"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// thumbnail statuses of uploads
+const (
+	thumbnailDone = "done"
+	thumbnailNone = "none"
+)
+
+// thumbnail settings
+const (
+	thumbnailSize = 320
+	// images bigger than this are not decoded, to stop decompression bombs
+	thumbnailMaxPixels = 50000000
+	thumbnailTimeout   = time.Minute
+	// ffmpeg needs a file, so bigger videos get no poster
+	thumbnailMaxVideoBytes = 1000000000
+)
+
+// thumbnailFile is where the thumbnail of the upload is stored
+func (p *Page) thumbnailFile() string {
+	return path.Join(getConfig().ContentDirectory, p.ID, p.ID+".thumb.jpg")
+}
+
+// HasThumbnail returns whether the upload has a thumbnail
+func (p *Page) HasThumbnail() bool {
+	return p.Thumbnail == thumbnailDone
+}
+
+// ThumbnailLink is the link to the thumbnail of the upload
+func (p *Page) ThumbnailLink() string {
+	return "/" + p.ID + "/thumb"
+}
+
+// needsThumbnail returns whether a thumbnail can be made for the upload
+// that was not made yet
+func (p *Page) needsThumbnail(cfg Config) bool {
+	if !cfg.Thumbnails || p.Thumbnail != "" || p.Scanning() || p.ScanFailed() {
+		return false
+	}
+	return p.IsImage || (p.IsVideo && cfg.ThumbnailFFmpeg != "")
+}
+
+// thumbnails keeps track of the thumbnails being made, so that each is
+// only made once at a time, and limits how many are made at once
+var thumbnails = struct {
+	sync.Mutex
+	running map[string]bool
+	slots   chan struct{}
+}{running: make(map[string]bool), slots: make(chan struct{}, 2)}
+
+// startThumbnail makes the thumbnail of an upload in the background
+func startThumbnail(p *Page) {
+	if !p.needsThumbnail(getConfig()) {
+		return
+	}
+	thumbnails.Lock()
+	if thumbnails.running[p.ID] {
+		thumbnails.Unlock()
+		return
+	}
+	thumbnails.running[p.ID] = true
+	thumbnails.Unlock()
+
+	go func() {
+		defer func() {
+			thumbnails.Lock()
+			delete(thumbnails.running, p.ID)
+			thumbnails.Unlock()
+		}()
+		thumbnails.slots <- struct{}{}
+		defer func() { <-thumbnails.slots }()
+		makeThumbnail(p)
+	}()
+}
+
+// makeThumbnail makes the thumbnail of an upload and records whether it
+// could be made
+func makeThumbnail(p *Page) {
+	start := time.Now()
+	var err error
+	if p.IsVideo {
+		err = p.videoThumbnail()
+	} else {
+		err = p.imageThumbnail()
+	}
+
+	// the upload may have been deleted in the meantime
+	current, errInfo := loadPageInfo(p.ID)
+	if errInfo != nil || current.Hash != p.Hash {
+		os.Remove(p.thumbnailFile())
+		return
+	}
+	p = current
+	if err != nil {
+		log.Debugf("no thumbnail for %s: %s", p.ID, err.Error())
+		p.Thumbnail = thumbnailNone
+	} else {
+		log.Debugf("made thumbnail for %s (%s)", p.ID, time.Since(start))
+		p.Thumbnail = thumbnailDone
+	}
+	if err = savePageInfo(p); err != nil {
+		log.Error(err)
+		return
+	}
+	pages.Put(p)
+}
+
+// imageThumbnail decodes the image and scales it down
+func (p *Page) imageThumbnail() (err error) {
+	rc, err := p.openData()
+	if err != nil {
+		return
+	}
+	config, _, err := image.DecodeConfig(rc)
+	rc.Close()
+	if err != nil {
+		return
+	}
+	if config.Width*config.Height > thumbnailMaxPixels {
+		return fmt.Errorf("image is too big (%dx%d)", config.Width, config.Height)
+	}
+
+	rc, err = p.openData()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	img, _, err := image.Decode(rc)
+	if err != nil {
+		return
+	}
+	return writeThumbnail(p.thumbnailFile(), img)
+}
+
+// writeThumbnail scales an image down to fit the thumbnail size and writes
+// it as JPEG
+func writeThumbnail(fname string, img image.Image) (err error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return fmt.Errorf("empty image")
+	}
+	if width > thumbnailSize || height > thumbnailSize {
+		if width > height {
+			width, height = thumbnailSize, max(1, height*thumbnailSize/width)
+		} else {
+			width, height = max(1, width*thumbnailSize/height), thumbnailSize
+		}
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	// transparent images get a white background
+	draw.Draw(thumb, thumb.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+	if err != nil {
+		return
+	}
+	return writeFileAtomic(fname, buf.Bytes())
+}
+
+// videoThumbnail takes a poster frame of the video with ffmpeg
+func (p *Page) videoThumbnail() (err error) {
+	cfg := getConfig()
+	if p.Size > thumbnailMaxVideoBytes {
+		return fmt.Errorf("video of %s is too big for a poster", p.SizeHuman)
+	}
+	src, err := p.decompressToTemp()
+	if err != nil {
+		return
+	}
+	defer os.Remove(src)
+	ctx, cancel := context.WithTimeout(context.Background(), thumbnailTimeout)
+	defer cancel()
+	tmp := p.thumbnailFile() + ".tmp.jpg"
+	defer os.Remove(tmp)
+	cmd := exec.CommandContext(ctx, cfg.ThumbnailFFmpeg,
+		"-hide_banner", "-loglevel", "error", "-y",
+		"-i", src,
+		"-vf", fmt.Sprintf("thumbnail,scale=%d:%d:force_original_aspect_ratio=decrease", thumbnailSize, thumbnailSize),
+		"-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", tmp)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s %s", cfg.ThumbnailFFmpeg, err.Error(), bytes.TrimSpace(out))
+	}
+	if info, errStat := os.Stat(tmp); errStat != nil || info.Size() == 0 {
+		return fmt.Errorf("%s made no poster", cfg.ThumbnailFFmpeg)
+	}
+	return os.Rename(tmp, p.thumbnailFile())
+}
+
+// decompressToTemp writes the decompressed data to a temporary file, for
+// tools that can not read from a pipe. The caller removes the file.
+func (p *Page) decompressToTemp() (fname string, err error) {
+	rc, err := p.openData()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	// named like the upload temp files so that it is cleaned up if it is
+	// left behind
+	tmp, err := os.CreateTemp(getConfig().ContentDirectory, "sharetemp")
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(tmp, rc)
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	return tmp.Name(), nil
+}
+
+// writeFileAtomic writes a file through a temporary file, so that it is
+// never read half written
+func writeFileAtomic(fname string, b []byte) (err error) {
+	err = os.WriteFile(fname+".tmp", b, 0644)
+	if err != nil {
+		return
+	}
+	return os.Rename(fname+".tmp", fname)
+}
+
+// handleThumb handles GET /<id>/thumb and returns the thumbnail of the
+// upload
+func handleThumb(w http.ResponseWriter, r *http.Request) (err error) {
+	p, err := loadRequestPage(r)
+	if err != nil {
+		return
+	}
+	if p.Name == "thumb" {
+		// the upload is named thumb
+		return p.handleView(w, r)
+	}
+	if p.refuseUnscanned(w, r) {
+		return
+	}
+	if !p.HasThumbnail() {
+		return errNotFound
+	}
+	b, err := os.ReadFile(p.thumbnailFile())
+	if err != nil {
+		log.Error(err)
+		return errNotFound
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	p.setUploadCacheControl(w)
+	if checkNotModified(w, r, `"`+p.Hash+`-thumb"`, p.Modified) {
+		return
+	}
+	_, err = w.Write(b)
+	return
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteThumbnail(t *testing.T) {
+	tests := []struct {
+		width      int
+		height     int
+		wantWidth  int
+		wantHeight int
+		wantErr    bool
+	}{
+		{100, 50, 100, 50, false},
+		{640, 480, thumbnailSize, 240, false},
+		{480, 640, 240, thumbnailSize, false},
+		{3000, 1, thumbnailSize, 1, false},
+		{0, 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		fname := filepath.Join(t.TempDir(), "thumb.jpg")
+		err := writeThumbnail(fname, image.NewNRGBA(image.Rect(0, 0, tt.width, tt.height)))
+		if tt.wantErr {
+			assert.NotNil(t, err)
+			continue
+		}
+		assert.Nil(t, err)
+		f, err := os.Open(fname)
+		assert.Nil(t, err)
+		config, err := jpeg.DecodeConfig(f)
+		f.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, tt.wantWidth, config.Width)
+		assert.Equal(t, tt.wantHeight, config.Height)
+	}
+}
+
+func TestImageThumbnail(t *testing.T) {
+	useTestConfig(t)
+	img := image.NewNRGBA(image.Rect(0, 0, 800, 400))
+	// transparent pixels get a white background
+	img.Set(0, 0, color.NRGBA{})
+	var buf bytes.Buffer
+	assert.Nil(t, png.Encode(&buf, img))
+	p := writeTestUpload(t, "abc", "a.png", buf.Bytes())
+	p.IsImage = true
+	assert.True(t, p.needsThumbnail(getConfig()))
+	assert.Nil(t, p.imageThumbnail())
+
+	f, err := os.Open(p.thumbnailFile())
+	assert.Nil(t, err)
+	defer f.Close()
+	thumb, err := jpeg.Decode(f)
+	assert.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, thumbnailSize, thumbnailSize/2), thumb.Bounds())
+	r, g, b, _ := thumb.At(0, 0).RGBA()
+	assert.Greater(t, r+g+b, uint32(3*0xf000))
+
+	// data that is not an image gets no thumbnail
+	p = writeTestUpload(t, "def", "a.png", []byte("not an image"))
+	assert.NotNil(t, p.imageThumbnail())
+}
+
+func TestNeedsThumbnail(t *testing.T) {
+	cfg := Config{Thumbnails: true}
+	withFFmpeg := Config{Thumbnails: true, ThumbnailFFmpeg: "ffmpeg"}
+	tests := []struct {
+		name string
+		cfg  Config
+		p    Page
+		want bool
+	}{
+		{"image", cfg, Page{IsImage: true}, true},
+		{"disabled", Config{}, Page{IsImage: true}, false},
+		{"done", cfg, Page{IsImage: true, Thumbnail: thumbnailDone}, false},
+		{"failed", cfg, Page{IsImage: true, Thumbnail: thumbnailNone}, false},
+		{"scanning", cfg, Page{IsImage: true, ScanStatus: scanPending}, false},
+		{"video", cfg, Page{IsVideo: true}, false},
+		{"video with ffmpeg", withFFmpeg, Page{IsVideo: true}, true},
+		{"text", withFFmpeg, Page{IsText: true}, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.p.needsThumbnail(tt.cfg), tt.name)
+	}
+}
+
+func TestDecompressToTemp(t *testing.T) {
+	useTestConfig(t)
+	p := writeTestUpload(t, "abc", "a.mp4", []byte("video data"))
+	fname, err := p.decompressToTemp()
+	assert.Nil(t, err)
+	defer os.Remove(fname)
+	b, err := os.ReadFile(fname)
+	assert.Nil(t, err)
+	assert.Equal(t, "video data", string(b))
+	assert.True(t, strings.HasPrefix(filepath.Base(fname), "sharetemp"))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certificate holds the current certificate loaded from the cert/key files
+// so that it can be replaced when the config is reloaded.
+var certificate atomic.Value
+
+// tlsEnabled returns whether the server terminates TLS itself
+func (cfg Config) tlsEnabled() bool {
+	return cfg.TLSCert != "" || cfg.ACMEDomains != ""
+}
+
+// acmeDomains returns the domains to request certificates for
+func (cfg Config) acmeDomains() (domains []string) {
+	for _, domain := range strings.Split(cfg.ACMEDomains, ",") {
+		domain = strings.TrimSpace(domain)
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return
+}
+
+// defaultPublicURL returns the public URL to use when none is configured
+func (cfg Config) defaultPublicURL() string {
+	if !cfg.tlsEnabled() {
+		return "http://localhost:" + cfg.Port
+	}
+	host := "localhost"
+	if domains := cfg.acmeDomains(); len(domains) > 0 {
+		host = domains[0]
+	}
+	if cfg.Port == "443" {
+		return "https://" + host
+	}
+	return "https://" + host + ":" + cfg.Port
+}
+
+// loadCertificate (re)loads the certificate from the cert/key files.
+func loadCertificate(cfg Config) (err error) {
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return
+	}
+	certificate.Store(&cert)
+	return
+}
+
+// setupTLS returns the TLS config for the server, and the handler for the
+// plain HTTP listener which redirects to HTTPS (and answers ACME challenges).
+// It returns a nil TLS config when TLS is not enabled.
+func setupTLS(cfg Config) (tlsConfig *tls.Config, httpHandler http.Handler, err error) {
+	if !cfg.tlsEnabled() {
+		return
+	}
+	httpHandler = http.HandlerFunc(redirectToHTTPS)
+
+	if cfg.TLSCert != "" {
+		err = loadCertificate(cfg)
+		if err != nil {
+			return
+		}
+		tlsConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			NextProtos: []string{"h2", "http/1.1"},
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return certificate.Load().(*tls.Certificate), nil
+			},
+		}
+		return
+	}
+
+	client := &acme.Client{DirectoryURL: cfg.ACMEDirectory}
+	if cfg.ACMECARoot != "" {
+		// trust a private ACME server, e.g. Pebble for testing
+		var b []byte
+		b, err = os.ReadFile(cfg.ACMECARoot)
+		if err != nil {
+			return
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(b) {
+			err = fmt.Errorf("no certificates found in %s", cfg.ACMECARoot)
+			return
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.ACMECacheDirectory),
+		HostPolicy: autocert.HostWhitelist(cfg.acmeDomains()...),
+		Email:      cfg.ACMEEmail,
+		Client:     client,
+	}
+	tlsConfig = manager.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+	httpHandler = manager.HTTPHandler(httpHandler)
+	return
+}
+
+// redirectToHTTPS redirects plain HTTP requests to the HTTPS port.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	cfg := getConfig()
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if cfg.Port != "443" {
+		host = net.JoinHostPort(host, cfg.Port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// withHSTS adds the Strict-Transport-Security header to every response.
+func withHSTS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg := getConfig(); cfg.HSTSSeconds > 0 {
+			w.Header().Set("Strict-Transport-Security", "max-age="+strconv.Itoa(cfg.HSTSSeconds))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultPublicURL(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{Port: "8222"}, "http://localhost:8222"},
+		{Config{Port: "443", TLSCert: "cert.pem"}, "https://localhost"},
+		{Config{Port: "443", ACMEDomains: " share.example.com, www.example.com"}, "https://share.example.com"},
+		{Config{Port: "8443", ACMEDomains: "share.example.com"}, "https://share.example.com:8443"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.cfg.defaultPublicURL())
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		port string
+		host string
+		want string
+	}{
+		{"443", "share.example.com", "https://share.example.com/123/a.txt?raw"},
+		{"443", "share.example.com:80", "https://share.example.com/123/a.txt?raw"},
+		{"8443", "share.example.com:8080", "https://share.example.com:8443/123/a.txt?raw"},
+	}
+	defer setConfig(getConfig())
+	for _, tt := range tests {
+		setConfig(Config{Port: tt.port})
+		r := httptest.NewRequest("GET", "http://"+tt.host+"/123/a.txt?raw", nil)
+		w := httptest.NewRecorder()
+		redirectToHTTPS(w, r)
+		assert.Equal(t, http.StatusMovedPermanently, w.Code)
+		assert.Equal(t, tt.want, w.Header().Get("Location"))
+	}
+}
+
+func TestWithHSTS(t *testing.T) {
+	defer setConfig(getConfig())
+	handler := withHSTS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for seconds, want := range map[int]string{0: "", 60: "max-age=60"} {
+		setConfig(Config{HSTSSeconds: seconds})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, want, w.Header().Get("Strict-Transport-Security"))
+	}
+}
+
+// acmeStandIn is a minimal ACME server for tests, like Pebble. It checks
+// the http-01 challenges against the handler of the plain HTTP listener and
+// issues certificates from its own CA. Signatures are not checked.
+type acmeStandIn struct {
+	server    *httptest.Server
+	challenge http.Handler
+	caKey     *ecdsa.PrivateKey
+	caCert    *x509.Certificate
+
+	sync.Mutex
+	nonce     int
+	domain    string
+	validated bool
+	cert      []byte
+}
+
+func newACMEStandIn(t *testing.T) *acmeStandIn {
+	s := &acmeStandIn{}
+	var err error
+	s.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &s.caKey.PublicKey, s.caKey)
+	assert.Nil(t, err)
+	s.caCert, _ = x509.ParseCertificate(der)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", s.handleDirectory)
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) { s.addNonce(w) })
+	mux.HandleFunc("/account", s.handleAccount)
+	mux.HandleFunc("/order", s.handleOrder)
+	mux.HandleFunc("/authz", s.handleAuthz)
+	mux.HandleFunc("/challenge", s.handleChallenge)
+	mux.HandleFunc("/finalize", s.handleFinalize)
+	mux.HandleFunc("/cert", s.handleCert)
+	s.server = httptest.NewTLSServer(mux)
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *acmeStandIn) addNonce(w http.ResponseWriter) {
+	s.Lock()
+	s.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", s.nonce))
+	s.Unlock()
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// payload returns the payload of a JWS request
+func (s *acmeStandIn) payload(r *http.Request, v interface{}) error {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil || len(b) == 0 || v == nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (s *acmeStandIn) reply(w http.ResponseWriter, code int, location string, v interface{}) {
+	s.addNonce(w)
+	if location != "" {
+		w.Header().Set("Location", s.server.URL+location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *acmeStandIn) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"newNonce":   s.server.URL + "/nonce",
+		"newAccount": s.server.URL + "/account",
+		"newOrder":   s.server.URL + "/order",
+		"revokeCert": s.server.URL + "/revoke",
+		"keyChange":  s.server.URL + "/key-change",
+		"meta":       map[string]string{"termsOfService": s.server.URL + "/terms"},
+	})
+}
+
+func (s *acmeStandIn) handleAccount(w http.ResponseWriter, r *http.Request) {
+	s.payload(r, nil)
+	s.reply(w, http.StatusCreated, "/account/1", map[string]string{"status": "valid"})
+}
+
+// order returns the state of the order
+func (s *acmeStandIn) order() map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+	order := map[string]interface{}{
+		"status":         "pending",
+		"identifiers":    []map[string]string{{"type": "dns", "value": s.domain}},
+		"authorizations": []string{s.server.URL + "/authz"},
+		"finalize":       s.server.URL + "/finalize",
+	}
+	if s.validated {
+		order["status"] = "ready"
+	}
+	if s.cert != nil {
+		order["status"] = "valid"
+		order["certificate"] = s.server.URL + "/cert"
+	}
+	return order
+}
+
+func (s *acmeStandIn) handleOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Identifiers []struct{ Value string }
+	}
+	s.payload(r, &req)
+	code := http.StatusOK
+	if len(req.Identifiers) > 0 {
+		// a new order, the others are requests for its state
+		s.Lock()
+		s.domain = req.Identifiers[0].Value
+		s.Unlock()
+		code = http.StatusCreated
+	}
+	s.reply(w, code, "/order", s.order())
+}
+
+// authz returns the state of the authorization
+func (s *acmeStandIn) authz() map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+	status := "pending"
+	if s.validated {
+		status = "valid"
+	}
+	return map[string]interface{}{
+		"status":     status,
+		"identifier": map[string]string{"type": "dns", "value": s.domain},
+		"challenges": []map[string]string{{"type": "http-01", "url": s.server.URL + "/challenge", "token": "token1", "status": status}},
+	}
+}
+
+func (s *acmeStandIn) handleAuthz(w http.ResponseWriter, r *http.Request) {
+	s.payload(r, nil)
+	s.reply(w, http.StatusOK, "", s.authz())
+}
+
+func (s *acmeStandIn) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	s.payload(r, nil)
+	// fetch the key authorization from the plain HTTP listener, like the CA
+	// would from port 80
+	s.Lock()
+	domain := s.domain
+	s.Unlock()
+	rec := httptest.NewRecorder()
+	s.challenge.ServeHTTP(rec, httptest.NewRequest("GET", "http://"+domain+"/.well-known/acme-challenge/token1", nil))
+	status := "invalid"
+	if rec.Code == http.StatusOK && strings.HasPrefix(rec.Body.String(), "token1.") {
+		s.Lock()
+		s.validated = true
+		s.Unlock()
+		status = "valid"
+	}
+	s.reply(w, http.StatusOK, "", map[string]string{"type": "http-01", "url": s.server.URL + "/challenge", "token": "token1", "status": status})
+}
+
+func (s *acmeStandIn) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CSR string
+	}
+	s.payload(r, &req)
+	b, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+	csr, err := x509.ParseCertificateRequest(b)
+	if err != nil {
+		s.reply(w, http.StatusBadRequest, "", map[string]string{"type": "urn:ietf:params:acme:error:badCSR"})
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		s.reply(w, http.StatusInternalServerError, "", map[string]string{"type": "urn:ietf:params:acme:error:serverInternal"})
+		return
+	}
+	s.Lock()
+	s.cert = der
+	s.Unlock()
+	s.reply(w, http.StatusOK, "/order", s.order())
+}
+
+func (s *acmeStandIn) handleCert(w http.ResponseWriter, r *http.Request) {
+	s.payload(r, nil)
+	s.addNonce(w)
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	s.Lock()
+	defer s.Unlock()
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.cert})
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})
+}
+
+func TestSetupTLSWithACME(t *testing.T) {
+	acmeServer := newACMEStandIn(t)
+	caRoot := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, os.WriteFile(caRoot, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: acmeServer.server.Certificate().Raw}), 0644))
+
+	cfg := Config{
+		Port:               "443",
+		ACMEDomains:        "share.example.com",
+		ACMEDirectory:      acmeServer.server.URL + "/directory",
+		ACMECARoot:         caRoot,
+		ACMECacheDirectory: t.TempDir(),
+	}
+	tlsConfig, httpHandler, err := setupTLS(cfg)
+	assert.Nil(t, err)
+	acmeServer.challenge = httpHandler
+
+	// other requests are still redirected
+	w := httptest.NewRecorder()
+	defer setConfig(getConfig())
+	setConfig(cfg)
+	httpHandler.ServeHTTP(w, httptest.NewRequest("GET", "http://share.example.com/", nil))
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+
+	cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "share.example.com"})
+	assert.Nil(t, err)
+	if assert.NotNil(t, cert) {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		assert.Nil(t, err)
+		assert.Nil(t, leaf.VerifyHostname("share.example.com"))
+		assert.Nil(t, leaf.CheckSignatureFrom(acmeServer.caCert))
+	}
+	assert.True(t, acmeServer.validated)
+
+	// only the configured domains get certificates
+	_, err = tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+	assert.NotNil(t, err)
+
+	// a CA file without certificates is refused
+	assert.Nil(t, os.WriteFile(caRoot, []byte("nothing"), 0644))
+	_, _, err = setupTLS(cfg)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// unfurlers are (lowercase substrings of) the User-Agents of the bots that
+// fetch links pasted into chats and social networks to show previews
+var unfurlers = []string{
+	"slackbot",
+	"discordbot",
+	"twitterbot",
+	"facebookexternalhit",
+	"facebot",
+	"linkedinbot",
+	"whatsapp",
+	"telegrambot",
+	"skypeuripreview",
+	"mattermost",
+	"rocket.chat",
+	"zulip",
+	"synapse",
+	"embedly",
+	"iframely",
+	"redditbot",
+	"pinterestbot",
+	"vkshare",
+	"bitlybot",
+	"applebot",
+	"google-pagerenderer",
+	"mastodon",
+	"bluesky",
+}
+
+// isUnfurler returns whether a User-Agent is a bot that shows previews of
+// links
+func isUnfurler(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, bot := range unfurlers {
+		if strings.Contains(userAgent, bot) {
+			return true
+		}
+	}
+	return false
+}
+
+// Description is the summary of the upload for link previews
+func (p *Page) Description() string {
+	return fmt.Sprintf("%s, deleted automatically in %s.", p.SizeHuman, p.TimeToDeletionHuman)
+}
+
+// AbsoluteRawURL is the absolute link to the data of the upload
+func (p *Page) AbsoluteRawURL() string {
+	if p.Config.userContentHost != "" {
+		return p.RawURL()
+	}
+	return p.Config.PublicURL + p.Link
+}
+
+// AbsoluteStreamURL is the absolute link to the decompressed data of the
+// upload, which players can seek in
+func (p *Page) AbsoluteStreamURL() string {
+	if p.Config.userContentHost != "" {
+		return p.StreamURL()
+	}
+	return p.Config.PublicURL + p.StreamLink()
+}
+
+// size of embedded videos, whose real size is not known
+const (
+	embedWidth  = 640
+	embedHeight = 360
+	// the height of the controls of an audio player
+	embedAudioHeight = 54
+)
+
+// imageSize returns the size of an image, from the data of the upload or
+// from a file if one is given
+func imageSize(p *Page, fname string) (width, height int, ok bool) {
+	var config image.Config
+	var err error
+	if fname == "" {
+		rc, errOpen := p.openData()
+		if errOpen != nil {
+			return
+		}
+		defer rc.Close()
+		config, _, err = image.DecodeConfig(rc)
+	} else {
+		f, errOpen := os.Open(fname)
+		if errOpen != nil {
+			return
+		}
+		defer f.Close()
+		config, _, err = image.DecodeConfig(f)
+	}
+	if err != nil {
+		return
+	}
+	return config.Width, config.Height, true
+}
+
+// oembedPage returns the upload that a link points to, for links like
+// https://share.example.com/123/name.txt
+func oembedPage(r *http.Request, link string) (p *Page, err error) {
+	u, err := url.Parse(link)
+	if err != nil || link == "" {
+		return nil, fmt.Errorf("Please give the link to a file with ?url=")
+	}
+	base, err := url.Parse(publicURL(r))
+	if err != nil {
+		return
+	}
+	if !strings.EqualFold(u.Host, base.Host) || !strings.HasPrefix(u.Path, base.Path+"/") {
+		return nil, errNotFound
+	}
+	id := strings.SplitN(strings.TrimPrefix(u.Path, base.Path+"/"), "/", 2)[0]
+	return loadPageForRequest(r, id)
+}
+
+// handleOEmbed handles GET /oembed?url=<link>, which describes an upload
+// for embedding it (https://oembed.com)
+func handleOEmbed(w http.ResponseWriter, r *http.Request) (err error) {
+	if format := r.URL.Query().Get("format"); format != "" && format != "json" {
+		jsonResponse(w, http.StatusNotImplemented, map[string]string{"message": "Only JSON is supported."})
+		return
+	}
+	p, err := oembedPage(r, r.URL.Query().Get("url"))
+	if err != nil {
+		return
+	}
+
+	response := map[string]interface{}{
+		"version":       "1.0",
+		"type":          "link",
+		"title":         p.Name,
+		"provider_name": "share",
+		"provider_url":  p.Config.PublicURL,
+		"cache_age":     int(p.timeRemaining().Seconds()),
+	}
+	available := !p.Scanning() && !p.ScanFailed()
+	if width, height, ok := imageSize(p, ""); available && p.IsImage && ok {
+		response["type"] = "photo"
+		response["url"] = p.AbsoluteRawURL()
+		response["width"] = width
+		response["height"] = height
+	} else if available && p.IsVideo {
+		response["type"] = "video"
+		response["html"] = fmt.Sprintf(`<video controls preload="metadata" src="%s" width="%d" height="%d"></video>`,
+			strings.ReplaceAll(p.AbsoluteStreamURL(), `"`, "%22"), embedWidth, embedHeight)
+		response["width"] = embedWidth
+		response["height"] = embedHeight
+	} else if available && p.IsAudio {
+		response["type"] = "rich"
+		response["html"] = fmt.Sprintf(`<audio controls preload="metadata" src="%s"></audio>`,
+			strings.ReplaceAll(p.AbsoluteStreamURL(), `"`, "%22"))
+		response["width"] = embedWidth
+		response["height"] = embedAudioHeight
+	}
+	if p.HasThumbnail() {
+		if width, height, ok := imageSize(p, p.thumbnailFile()); ok {
+			response["thumbnail_url"] = p.Config.PublicURL + p.ThumbnailLink()
+			response["thumbnail_width"] = width
+			response["thumbnail_height"] = height
+		}
+	}
+	jsonResponse(w, http.StatusOK, response)
+	return
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsUnfurler(t *testing.T) {
+	for userAgent, want := range map[string]bool{
+		"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)":                true,
+		"Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)":         true,
+		"TelegramBot (like TwitterBot)":                                             true,
+		"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)": true,
+		"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0":    false,
+		"curl/8.0": false,
+		"":         false,
+	} {
+		assert.Equal(t, want, isUnfurler(userAgent), userAgent)
+	}
+}
+
+func TestHandleOEmbed(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.PublicURL = "https://share.example.com"
+	finalizeConfig(&cfg)
+	setConfig(cfg)
+	upload := func(id, name, contentType string) {
+		p := writeTestUpload(t, id, name, []byte("data"))
+		p.ContentType = contentType
+		p.IsVideo = contentType == "video/mp4"
+		p.IsAudio = contentType == "audio/mpeg"
+		p.Link = "/1/" + id + "/" + name
+		assert.Nil(t, savePageInfo(p))
+	}
+	upload("vid", "a.mp4", "video/mp4")
+	upload("aud", "a.mp3", "audio/mpeg")
+	upload("txt", "a.txt", "text/plain; charset=utf-8")
+
+	tests := []struct {
+		link     string
+		want     int
+		wantType string
+		wantHTML string
+	}{
+		{"https://share.example.com/vid/a.mp4", http.StatusOK, "video", `<video controls preload="metadata" src="https://share.example.com/stream/vid/a.mp4" width="640" height="360"></video>`},
+		{"https://share.example.com/aud/a.mp3", http.StatusOK, "rich", `<audio controls preload="metadata" src="https://share.example.com/stream/aud/a.mp3"></audio>`},
+		{"https://share.example.com/txt", http.StatusOK, "link", ""},
+		{"https://share.example.com/missing/a.txt", http.StatusNotFound, "", ""},
+		{"https://elsewhere.example.com/txt/a.txt", http.StatusNotFound, "", ""},
+		{"", http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/oembed?url="+url.QueryEscape(tt.link), nil)
+		w := httptest.NewRecorder()
+		err := handleOEmbed(w, r)
+		switch tt.want {
+		case http.StatusNotFound:
+			assert.IsType(t, notFoundError{}, err, tt.link)
+			continue
+		case http.StatusBadRequest:
+			assert.NotNil(t, err, tt.link)
+			continue
+		}
+		assert.Nil(t, err, tt.link)
+		var response map[string]interface{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, tt.wantType, response["type"], tt.link)
+		if tt.wantHTML != "" {
+			assert.Equal(t, tt.wantHTML, response["html"], tt.link)
+		}
+	}
+}
+
+func TestAbsoluteURLs(t *testing.T) {
+	p := &Page{ID: "123", Name: "a.mp4", Link: "/1/123/a.mp4", Config: Config{PublicURL: "https://share.example.com"}}
+	assert.Equal(t, "https://share.example.com/1/123/a.mp4", p.AbsoluteRawURL())
+	assert.Equal(t, "https://share.example.com/stream/123/a.mp4", p.AbsoluteStreamURL())
+	p.Config.UserContentURL = "https://usercontent.example.com/"
+	p.Config.userContentHost = "usercontent.example.com"
+	assert.Equal(t, "https://usercontent.example.com/1/123/a.mp4", p.AbsoluteRawURL())
+	assert.Equal(t, "https://usercontent.example.com/stream/123/a.mp4", p.AbsoluteStreamURL())
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/schollz/logger"
+)
+
+// userContentCSP is the content security policy of uploads, which keeps
+// scripts in them from running and from reaching anything
+const userContentCSP = "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'; sandbox"
+
+// pdfCSP is the content security policy of PDFs, which are only shown
+// inline from the usercontent domain. Browsers that do not show PDFs in a
+// sandbox offer them as a download.
+const pdfCSP = "default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; sandbox"
+
+// activeTypes are the content types that browsers run scripts in, which are
+// always downloaded instead of shown
+var activeTypes = map[string]bool{
+	"text/html":                     true,
+	"application/xhtml+xml":         true,
+	"image/svg+xml":                 true,
+	"text/xml":                      true,
+	"application/xml":               true,
+	"text/javascript":               true,
+	"application/javascript":        true,
+	"application/ecmascript":        true,
+	"text/xsl":                      true,
+	"application/x-shockwave-flash": true,
+	"multipart/x-mixed-replace":     true,
+}
+
+// isActiveType returns whether browsers run scripts in a content type
+func isActiveType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// browsers might sniff what they do not understand
+		return true
+	}
+	return activeTypes[mediaType] || strings.HasSuffix(mediaType, "+xml")
+}
+
+// setUserContentHeaders sets the headers of the data of an upload, so that
+// browsers do not sniff it and do not run it in the origin of share. PDFs
+// can run scripts too, so they are downloaded unless there is a usercontent
+// domain.
+func (p *Page) setUserContentHeaders(w http.ResponseWriter) {
+	contentType := p.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	isPDF := strings.HasPrefix(contentType, "application/pdf")
+	disposition := "inline"
+	if isActiveType(contentType) || (isPDF && p.Config.userContentHost == "") {
+		disposition = "attachment"
+	}
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": p.Name}))
+	if isPDF {
+		h.Set("Content-Security-Policy", pdfCSP)
+	} else {
+		h.Set("Content-Security-Policy", userContentCSP)
+	}
+}
+
+// parseUserContentHost returns the host of the usercontent URL
+func parseUserContentHost(userContentURL string) string {
+	if userContentURL == "" {
+		return ""
+	}
+	u, err := url.Parse(userContentURL)
+	if err != nil || u.Host == "" {
+		log.Warnf("usercontent-url: %q is not a URL, serving uploads from the public URL", userContentURL)
+		return ""
+	}
+	return u.Host
+}
+
+// userContentBase is where the data of uploads is served from: the
+// usercontent URL if there is one or else the base path
+func (cfg Config) userContentBase() string {
+	if cfg.userContentHost != "" {
+		return strings.TrimSuffix(cfg.UserContentURL, "/")
+	}
+	return cfg.BasePath
+}
+
+// RawURL is the link to the data of the upload
+func (p *Page) RawURL() string {
+	return p.Config.userContentBase() + p.Link
+}
+
+// StreamURL is the link to the decompressed data of the upload
+func (p *Page) StreamURL() string {
+	return p.Config.userContentBase() + p.StreamLink()
+}
+
+// userContentRoutes are the routes of the usercontent domain
+var userContentRoutes = map[string]bool{
+	"raw":     true,
+	"stream":  true,
+	"healthz": true,
+	"readyz":  true,
+}
+
+// separateUserContent is the middleware that serves the data of uploads
+// only from the usercontent domain, if there is one, and nothing else from
+// it
+func separateUserContent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		if cfg.userContentHost == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// the base path is already stripped
+		uri := (&url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery}).RequestURI()
+		name := routeName(r)
+		onUserContent := strings.EqualFold(requestHost(r), cfg.userContentHost)
+		switch {
+		case onUserContent && !userContentRoutes[name]:
+			base := strings.TrimSuffix(cfg.PublicURL, "/")
+			if !strings.HasSuffix(base, cfg.BasePath) {
+				base += cfg.BasePath
+			}
+			http.Redirect(w, r, base+uri, http.StatusFound)
+		case !onUserContent && (name == "raw" || name == "stream"):
+			http.Redirect(w, r, cfg.userContentBase()+uri, http.StatusFound)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
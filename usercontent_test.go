@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetUserContentHeaders(t *testing.T) {
+	tests := []struct {
+		name            string
+		contentType     string
+		userContentHost string
+		wantType        string
+		wantInline      bool
+		wantCSP         string
+	}{
+		{"text", "text/plain; charset=utf-8", "", "text/plain; charset=utf-8", true, userContentCSP},
+		{"unknown", "", "", "application/octet-stream", true, userContentCSP},
+		{"html", "text/html; charset=utf-8", "usercontent.example.com", "text/html; charset=utf-8", false, userContentCSP},
+		{"svg", "image/svg+xml", "", "image/svg+xml", false, userContentCSP},
+		{"broken type", "text/html; charset", "", "text/html; charset", false, userContentCSP},
+		{"pdf", "application/pdf", "", "application/pdf", false, pdfCSP},
+		{"pdf on usercontent", "application/pdf", "usercontent.example.com", "application/pdf", true, pdfCSP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Page{Name: "a file", ContentType: tt.contentType, Config: Config{userContentHost: tt.userContentHost}}
+			w := httptest.NewRecorder()
+			p.setUserContentHeaders(w)
+			assert.Equal(t, tt.wantType, w.Header().Get("Content-Type"))
+			assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+			want := `attachment; filename="a file"`
+			if tt.wantInline {
+				want = `inline; filename="a file"`
+			}
+			assert.Equal(t, want, w.Header().Get("Content-Disposition"))
+			assert.Equal(t, tt.wantCSP, w.Header().Get("Content-Security-Policy"))
+			assert.Contains(t, w.Header().Get("Content-Security-Policy"), "sandbox")
+		})
+	}
+}
+
+func TestSeparateUserContent(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.PublicURL = "https://share.example.com"
+	cfg.UserContentURL = "https://usercontent.example.com"
+	finalizeConfig(&cfg)
+	setConfig(cfg)
+
+	rt := &router{}
+	rt.Use(separateUserContent)
+	ok := func(w http.ResponseWriter, r *http.Request) error { return nil }
+	rt.Handle("raw", "GET", "/1/{id}/{name}", ok)
+	rt.Handle("view", "GET", "/{id}/{name}", ok)
+	tests := []struct {
+		url          string
+		want         int
+		wantLocation string
+	}{
+		{"https://usercontent.example.com/1/123/a.txt", http.StatusOK, ""},
+		{"https://usercontent.example.com/123/a.txt?view", http.StatusFound, "https://share.example.com/123/a.txt?view"},
+		{"https://share.example.com/1/123/a.txt", http.StatusFound, "https://usercontent.example.com/1/123/a.txt"},
+		{"https://share.example.com/123/a.txt", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		assert.Equal(t, tt.want, w.Code, tt.url)
+		assert.Equal(t, tt.wantLocation, w.Header().Get("Location"), tt.url)
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/schollz/logger"
+	"golang.org/x/image/draw"
+)
+
+// variant settings
+const (
+	// variantMaxSize is the biggest width or height that can be asked for
+	variantMaxSize = 4096
+	// variantsPerUpload is how many variants of an upload are kept, the
+	// least recently used are removed first
+	variantsPerUpload = 8
+	variantQuality    = 85
+)
+
+// variantFormats are the formats that variants can be encoded in, with
+// their content types. WebP can be decoded but not encoded with the
+// standard library and x/image, so it is not one of them.
+var variantFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+}
+
+// variantOptions are the size and format of a variant of an image
+type variantOptions struct {
+	Width  int
+	Height int
+	Format string
+}
+
+// wantsVariant returns whether a request asks for a variant of an image
+// with ?w, ?h or ?format
+func wantsVariant(r *http.Request) bool {
+	query := r.URL.Query()
+	return query.Has("w") || query.Has("h") || query.Has("format")
+}
+
+// parseVariantOptions parses ?w=800&h=600&format=jpeg, where all are
+// optional
+func parseVariantOptions(r *http.Request) (opts variantOptions, err error) {
+	query := r.URL.Query()
+	for _, param := range []struct {
+		name string
+		dst  *int
+	}{{"w", &opts.Width}, {"h", &opts.Height}} {
+		v := query.Get(param.name)
+		if v == "" {
+			continue
+		}
+		*param.dst, err = strconv.Atoi(v)
+		if err != nil || *param.dst < 1 || *param.dst > variantMaxSize {
+			return opts, fmt.Errorf("%s must be a number of pixels from 1 to %d.", param.name, variantMaxSize)
+		}
+	}
+	opts.Format = strings.ToLower(query.Get("format"))
+	if opts.Format == "jpg" {
+		opts.Format = "jpeg"
+	}
+	if opts.Format == "webp" {
+		return opts, fmt.Errorf("WebP can not be encoded, use format=jpeg or format=png.")
+	}
+	if _, ok := variantFormats[opts.Format]; opts.Format != "" && !ok {
+		return opts, fmt.Errorf("Unknown format %q, use jpeg, png or gif.", opts.Format)
+	}
+	return
+}
+
+// fit returns the size of the variant of an image of the given size, which
+// keeps its aspect ratio and is never bigger than the image
+func (opts variantOptions) fit(width, height int) (int, int) {
+	scale := 1.0
+	if opts.Width > 0 && opts.Width < width {
+		scale = float64(opts.Width) / float64(width)
+	}
+	if opts.Height > 0 && opts.Height < height {
+		scale = min(scale, float64(opts.Height)/float64(height))
+	}
+	return max(1, int(float64(width)*scale+0.5)), max(1, int(float64(height)*scale+0.5))
+}
+
+// variantFile is where a variant of the upload is cached
+func (p *Page) variantFile(width, height int, format string) string {
+	return path.Join(getConfig().ContentDirectory, p.ID, fmt.Sprintf("%s.variant.%dx%d.%s", p.ID, width, height, format))
+}
+
+// isVariantFile returns whether a file in the directory of an upload is a
+// cached variant
+func isVariantFile(id string, name string) bool {
+	return strings.HasPrefix(name, id+".variant.")
+}
+
+// variantLocks make sure that each upload makes one variant at a time.
+// Uploads share a fixed number of locks by the hash of their ID, so they
+// don't need to be removed when the uploads are.
+var variantLocks [64]sync.Mutex
+
+// variantLock returns the lock of an upload
+func variantLock(id string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &variantLocks[h.Sum32()%uint32(len(variantLocks))]
+}
+
+// variantSlots limits how many variants are made at once
+var variantSlots = make(chan struct{}, 2)
+
+// variant returns the file of a variant of the image, making it if it is
+// not cached, and its content type
+func (p *Page) variant(opts variantOptions) (fname string, contentType string, err error) {
+	lock := variantLock(p.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	rc, err := p.openData()
+	if err != nil {
+		return
+	}
+	br := bufio.NewReader(rc)
+	config, format, err := image.DecodeConfig(br)
+	rc.Close()
+	if err != nil {
+		return "", "", fmt.Errorf("%s can not be resized.", p.Name)
+	}
+	if config.Width*config.Height > thumbnailMaxPixels {
+		return "", "", fmt.Errorf("%s is too big to be resized (%dx%d).", p.Name, config.Width, config.Height)
+	}
+	if format == "gif" && p.isAnimatedGIF() {
+		return "", "", fmt.Errorf("%s is animated and can not be resized.", p.Name)
+	}
+	orientation := uint16(1)
+	if format == "jpeg" {
+		orientation = p.jpegOrientation()
+	}
+	if orientation >= 5 {
+		// rotated by 90 degrees
+		config.Width, config.Height = config.Height, config.Width
+	}
+	width, height := opts.fit(config.Width, config.Height)
+
+	// the same image can be decoded, but not always encoded
+	if opts.Format == "" {
+		opts.Format = format
+	}
+	candidates := []string{opts.Format}
+	if _, ok := variantFormats[opts.Format]; !ok {
+		// e.g. WebP, which is made into a JPEG or a PNG
+		candidates = []string{"jpeg", "png"}
+	}
+	for _, candidate := range candidates {
+		fname = p.variantFile(width, height, candidate)
+		if _, errStat := os.Stat(fname); errStat == nil {
+			now := time.Now()
+			os.Chtimes(fname, now, now)
+			return fname, variantFormats[candidate], nil
+		}
+	}
+
+	variantSlots <- struct{}{}
+	defer func() { <-variantSlots }()
+	rc, err = p.openData()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	img, _, err := image.Decode(rc)
+	if err != nil {
+		return "", "", fmt.Errorf("%s can not be resized.", p.Name)
+	}
+	if _, ok := variantFormats[opts.Format]; !ok {
+		// kept lossless if it has transparency
+		opts.Format = "jpeg"
+		if opaque, ok := img.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+			opts.Format = "png"
+		}
+	}
+	fname = p.variantFile(width, height, opts.Format)
+	contentType = variantFormats[opts.Format]
+
+	start := time.Now()
+	b, err := encodeVariant(img, width, height, orientation, opts.Format)
+	if err != nil {
+		return
+	}
+	if err = writeFileAtomic(fname, b); err != nil {
+		return
+	}
+	log.Debugf("made %dx%d %s of %s (%s)", width, height, opts.Format, p.ID, time.Since(start))
+	p.trimVariants()
+	trimVariantCache(fname)
+	return
+}
+
+// encodeVariant scales an image to the given size, turns it as its
+// orientation says and encodes it
+func encodeVariant(img image.Image, width, height int, orientation uint16, format string) (b []byte, err error) {
+	if orientation >= 5 {
+		// turned after scaling, which is cheaper
+		width, height = height, width
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	if format == "jpeg" {
+		// JPEG has no transparency
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
+	scaled := orient(dst, orientation)
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: variantQuality})
+	case "png":
+		err = png.Encode(&buf, scaled)
+	case "gif":
+		err = gif.Encode(&buf, scaled, nil)
+	default:
+		err = fmt.Errorf("unknown format %s", format)
+	}
+	return buf.Bytes(), err
+}
+
+// trimVariants removes the least recently used variants of the upload
+// when there are too many
+func (p *Page) trimVariants() {
+	files, err := filepath.Glob(path.Join(getConfig().ContentDirectory, p.ID, p.ID+".variant.*"))
+	if err != nil || len(files) <= variantsPerUpload {
+		return
+	}
+	modified := make(map[string]time.Time)
+	for _, fname := range files {
+		if info, errStat := os.Stat(fname); errStat == nil {
+			modified[fname] = info.ModTime()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return modified[files[i]].Before(modified[files[j]])
+	})
+	for _, fname := range files[:len(files)-variantsPerUpload] {
+		log.Debugf("removing variant %s", fname)
+		os.Remove(fname)
+	}
+}
+
+// variantCacheLock makes sure that the cache is trimmed by one variant at
+// a time
+var variantCacheLock sync.Mutex
+
+// trimVariantCache removes the least recently used variants of all uploads
+// when they are bigger than the variant cache size, except for the variant
+// that was just made
+func trimVariantCache(keep string) {
+	maxBytes := getConfig().VariantCacheBytes
+	if maxBytes <= 0 {
+		return
+	}
+	variantCacheLock.Lock()
+	defer variantCacheLock.Unlock()
+	files, err := filepath.Glob(path.Join(getConfig().ContentDirectory, "*", "*.variant.*"))
+	if err != nil {
+		return
+	}
+	type variantInfo struct {
+		name     string
+		size     int64
+		modified time.Time
+	}
+	var variants []variantInfo
+	var total int64
+	for _, fname := range files {
+		info, errStat := os.Stat(fname)
+		if errStat != nil || !isVariantFile(filepath.Base(filepath.Dir(fname)), info.Name()) {
+			continue
+		}
+		variants = append(variants, variantInfo{fname, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(variants, func(i, j int) bool {
+		return variants[i].modified.Before(variants[j].modified)
+	})
+	for _, v := range variants {
+		if total <= maxBytes {
+			break
+		}
+		if v.name == keep {
+			continue
+		}
+		log.Debugf("removing variant %s", v.name)
+		if os.Remove(v.name) == nil {
+			total -= v.size
+		}
+	}
+}
+
+// jpegOrientation returns the Exif orientation of a JPEG upload, or 1 if
+// it has none
+func (p *Page) jpegOrientation() uint16 {
+	rc, err := p.openData()
+	if err != nil {
+		return 1
+	}
+	defer rc.Close()
+	r := bufio.NewReader(rc)
+	if _, err = r.Discard(2); err != nil {
+		return 1
+	}
+	for {
+		marker, err := readJPEGMarker(r)
+		if err != nil || marker == jpegSOS || marker == jpegEOI {
+			return 1
+		}
+		if marker >= 0xD0 && marker <= 0xD7 || marker == 0x01 {
+			continue
+		}
+		var size uint16
+		if err = binary.Read(r, binary.BigEndian, &size); err != nil || size < 2 {
+			return 1
+		}
+		if marker != jpegAPP1 {
+			if _, err = r.Discard(int(size) - 2); err != nil {
+				return 1
+			}
+			continue
+		}
+		payload := make([]byte, size-2)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return 1
+		}
+		if orientation := exifOrientation(payload); orientation >= 1 && orientation <= 8 {
+			return orientation
+		}
+	}
+}
+
+// isAnimatedGIF returns whether a GIF upload has more than one frame
+func (p *Page) isAnimatedGIF() bool {
+	rc, err := p.openData()
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	return gifFrames(bufio.NewReader(rc), 2) >= 2
+}
+
+// gifFrames counts the frames of a GIF, up to max, by walking its blocks
+// without decoding them
+func gifFrames(r *bufio.Reader, max int) (frames int) {
+	// the header and the logical screen descriptor
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+	if header[10]&0x80 != 0 {
+		// the global color table
+		if _, err := r.Discard(3 << (header[10]&0x07 + 1)); err != nil {
+			return
+		}
+	}
+	for frames < max {
+		introducer, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch introducer {
+		case 0x21:
+			// an extension, with its label
+			if _, err = r.Discard(1); err != nil {
+				return
+			}
+		case 0x2C:
+			frames++
+			descriptor := make([]byte, 9)
+			if _, err = io.ReadFull(r, descriptor); err != nil {
+				return
+			}
+			skip := 1 // the minimum code size
+			if descriptor[8]&0x80 != 0 {
+				// the local color table
+				skip += 3 << (descriptor[8]&0x07 + 1)
+			}
+			if _, err = r.Discard(skip); err != nil {
+				return
+			}
+		default:
+			// the trailer, or not a GIF
+			return
+		}
+		// the data sub-blocks, up to one of size 0
+		for {
+			size, err := r.ReadByte()
+			if err != nil || size == 0 {
+				break
+			}
+			if _, err = r.Discard(int(size)); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// orient rotates and flips an image as its Exif orientation says, since
+// the decoders ignore it
+func orient(img image.Image, orientation uint16) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // flipped horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated by 180 degrees
+				dx, dy = w-1-x, h-1-y
+			case 4: // flipped vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated by 90 degrees clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated by 90 degrees counterclockwise
+				dx, dy = y, w-1-x
+			}
+			out.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// handleVariant returns a resized or converted variant of an image upload
+func (p *Page) handleVariant(w http.ResponseWriter, r *http.Request) (err error) {
+	opts, err := parseVariantOptions(r)
+	if err != nil {
+		return
+	}
+	if !p.IsImage {
+		return fmt.Errorf("Only images can be resized.")
+	}
+	fname, contentType, err := p.variant(opts)
+	if err != nil {
+		return
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	// the variant is served like an upload of its own
+	v := *p
+	v.ContentType = contentType
+	ext := filepath.Ext(fname)
+	if ext == ".jpeg" {
+		ext = ".jpg"
+	}
+	v.Name = strings.TrimSuffix(p.Name, filepath.Ext(p.Name)) + ext
+	v.setUserContentHeaders(w)
+	w.Header().Set("ETag", `"`+p.Hash+"-"+strings.TrimPrefix(filepath.Base(fname), p.ID+".")+`"`)
+	p.setUploadCacheControl(w)
+	rec := &responseRecorder{ResponseWriter: throttleResponse(w, r, downloadBandwidth(r, p.Config))}
+	http.ServeContent(rec, r, v.Name, p.Modified, f)
+	observeDownload(r, rec.Bytes)
+	if r.Method == http.MethodGet {
+		auditRequest(r, auditEventDownload, p)
+	}
+	return
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVariantOptions(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    variantOptions
+		wantErr bool
+	}{
+		{"w=800", variantOptions{Width: 800}, false},
+		{"w=800&h=600&format=PNG", variantOptions{Width: 800, Height: 600, Format: "png"}, false},
+		{"format=jpg", variantOptions{Format: "jpeg"}, false},
+		{"w=0", variantOptions{}, true},
+		{"h=5000", variantOptions{}, true},
+		{"w=big", variantOptions{}, true},
+		{"format=webp", variantOptions{}, true},
+		{"format=bmp", variantOptions{}, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/1/abc/a.png?"+tt.query, nil)
+		assert.True(t, wantsVariant(r))
+		opts, err := parseVariantOptions(r)
+		if tt.wantErr {
+			assert.NotNil(t, err, tt.query)
+			continue
+		}
+		assert.Nil(t, err, tt.query)
+		assert.Equal(t, tt.want, opts, tt.query)
+	}
+	assert.False(t, wantsVariant(httptest.NewRequest("GET", "/1/abc/a.png", nil)))
+}
+
+func TestVariantFit(t *testing.T) {
+	tests := []struct {
+		opts       variantOptions
+		width      int
+		height     int
+		wantWidth  int
+		wantHeight int
+	}{
+		{variantOptions{Width: 400}, 800, 600, 400, 300},
+		{variantOptions{Height: 300}, 800, 600, 400, 300},
+		{variantOptions{Width: 400, Height: 100}, 800, 600, 133, 100},
+		{variantOptions{Width: 2000}, 800, 600, 800, 600},
+		{variantOptions{Width: 1}, 800, 2, 1, 1},
+		{variantOptions{}, 800, 600, 800, 600},
+	}
+	for _, tt := range tests {
+		width, height := tt.opts.fit(tt.width, tt.height)
+		assert.Equal(t, tt.wantWidth, width)
+		assert.Equal(t, tt.wantHeight, height)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// a 2x1 image with a red pixel on the left
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	red := color.NRGBA{255, 0, 0, 255}
+	img.Set(0, 0, red)
+	tests := []struct {
+		orientation uint16
+		wantSize    image.Point
+		wantRed     image.Point
+	}{
+		{1, image.Pt(2, 1), image.Pt(0, 0)},
+		{2, image.Pt(2, 1), image.Pt(1, 0)},
+		{3, image.Pt(2, 1), image.Pt(1, 0)},
+		{6, image.Pt(1, 2), image.Pt(0, 0)},
+		{8, image.Pt(1, 2), image.Pt(0, 1)},
+	}
+	for _, tt := range tests {
+		out := orient(img, tt.orientation)
+		assert.Equal(t, tt.wantSize, out.Bounds().Size(), tt.orientation)
+		assert.Equal(t, red, color.NRGBAModel.Convert(out.At(tt.wantRed.X, tt.wantRed.Y)), tt.orientation)
+	}
+}
+
+// testGIF encodes a GIF with the number of frames, each with a local color
+// table
+func testGIF(t *testing.T, frames int) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 10, 10), palette.Plan9))
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, gif.EncodeAll(&buf, g))
+	return buf.Bytes()
+}
+
+func TestGIFFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"one frame", testGIF(t, 1), 1},
+		{"animated", testGIF(t, 3), 3},
+		{"truncated", testGIF(t, 3)[:20], 0},
+		{"not a gif", []byte("hello, world"), 0},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, gifFrames(bufio.NewReader(bytes.NewReader(tt.data)), 10), tt.name)
+	}
+	assert.Equal(t, 2, gifFrames(bufio.NewReader(bytes.NewReader(testGIF(t, 3))), 2))
+}
+
+func TestVariant(t *testing.T) {
+	useTestConfig(t)
+	var buf bytes.Buffer
+	assert.Nil(t, png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 800, 400))))
+	p := writeTestUpload(t, "abc", "a.png", buf.Bytes())
+	fname, contentType, err := p.variant(variantOptions{Width: 200, Format: "jpeg"})
+	assert.Nil(t, err)
+	assert.Equal(t, "image/jpeg", contentType)
+	assert.Equal(t, p.variantFile(200, 100, "jpeg"), fname)
+	assert.FileExists(t, fname)
+
+	// the variants are trimmed to the most recently used
+	for width := 1; width <= variantsPerUpload+2; width++ {
+		_, _, err = p.variant(variantOptions{Width: width * 10})
+		assert.Nil(t, err)
+	}
+	_, err = os.Stat(fname)
+	assert.True(t, os.IsNotExist(err))
+
+	p = writeTestUpload(t, "def", "a.gif", testGIF(t, 2))
+	_, _, err = p.variant(variantOptions{Width: 5})
+	assert.NotNil(t, err)
+	p = writeTestUpload(t, "ghi", "a.gif", testGIF(t, 1))
+	_, contentType, err = p.variant(variantOptions{Width: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, "image/gif", contentType)
+}
+
+func TestVariantLock(t *testing.T) {
+	assert.Same(t, variantLock("abc"), variantLock("abc"))
+}
+
+func TestTrimVariantCache(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.VariantCacheBytes = 2500
+	setConfig(cfg)
+	now := time.Now()
+	var files []string
+	for i, id := range []string{"abc", "def", "abc", "def"} {
+		dir := filepath.Join(cfg.ContentDirectory, id)
+		assert.Nil(t, os.MkdirAll(dir, 0755))
+		fname := filepath.Join(dir, fmt.Sprintf("%s.variant.%dx1.png", id, i))
+		assert.Nil(t, os.WriteFile(fname, make([]byte, 1000), 0644))
+		modified := now.Add(time.Duration(i-10) * time.Minute)
+		assert.Nil(t, os.Chtimes(fname, modified, modified))
+		files = append(files, fname)
+	}
+	// uploads are not variants
+	upload := filepath.Join(cfg.ContentDirectory, "abc", "photo.variant.png")
+	assert.Nil(t, os.WriteFile(upload, make([]byte, 5000), 0644))
+
+	// the oldest is kept when it was just made
+	trimVariantCache(files[0])
+	assert.FileExists(t, files[0])
+	assert.NoFileExists(t, files[1])
+	assert.NoFileExists(t, files[2])
+	assert.FileExists(t, files[3])
+	assert.FileExists(t, upload)
+
+	// variants are not counted with the uploads
+	size, biggest, err := DirSize(cfg.ContentDirectory)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5000), size)
+	assert.Equal(t, "abc", biggest)
+}